@@ -36,3 +36,17 @@ func (adapter *bottleAdapter) mapTestString(s string) bool {
 func (adapter *bottleAdapter) mapAddString(s string) {
 	adapter.HashMap[s] = true
 }
+
+// kind returns k, turned into its probable form when the rules are kept in the bloom filter.
+func (adapter *bottleAdapter) kind(k matchKind) matchKind {
+	if adapter.BloomFilter == nil {
+		return k
+	}
+	switch k {
+	case matchExact:
+		return matchBloom
+	case matchWildcard:
+		return matchBloomWildcard
+	}
+	return k
+}
@@ -0,0 +1,117 @@
+package turned
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminServer exposes the rule overlay over HTTP, all requests must carry "Authorization: Bearer <token>".
+type adminServer struct {
+	*httpServer
+	token   string
+	overlay *ruleOverlay
+}
+
+func newAdminServer() *adminServer {
+	a := &adminServer{httpServer: newHTTPServer(""), overlay: newRuleOverlay()}
+	a.mux.HandleFunc("/rules", a.auth(a.serveRules))
+	return a
+}
+
+// setup checks the admin settings once all groups are parsed and loads the persisted rules.
+func (a *adminServer) setup(nodes []*Forward) error {
+	if a.addr == "" {
+		return errors.New("admin_http: no listen address")
+	}
+	if a.token == "" {
+		return errors.New("admin_http: no admin_token")
+	}
+	a.overlay.nodes = nodes
+	return a.overlay.load()
+}
+
+// adminRule is the body of POST /rules. TTL is a duration after which the rule expires, Expire an
+// absolute RFC 3339 time, both are optional.
+type adminRule struct {
+	Name   string    `json:"name"`
+	Group  string    `json:"group"`
+	TTL    string    `json:"ttl"`
+	Expire time.Time `json:"expire"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func (a *adminServer) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, adminError{http.StatusText(http.StatusUnauthorized)})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// serveRules lists (GET), adds (POST) and removes (DELETE /rules?name=) the overlay rules.
+func (a *adminServer) serveRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rules, err := a.overlay.list()
+		if err != nil {
+			log.Errorf("[Overlay] %s", err)
+		}
+		writeJSON(w, http.StatusOK, rules)
+
+	case http.MethodPost:
+		var req adminRule
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{err.Error()})
+			return
+		}
+		expire := req.Expire
+		if req.TTL != "" {
+			ttl, err := time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 {
+				writeJSON(w, http.StatusBadRequest, adminError{"invalid ttl: " + req.TTL})
+				return
+			}
+			expire = time.Now().Add(ttl)
+		}
+
+		rule, err := a.overlay.add(req.Name, req.Group, expire)
+		if rule == nil {
+			writeJSON(w, http.StatusBadRequest, adminError{err.Error()})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, adminError{err.Error()})
+			return
+		}
+		log.Infof("[Overlay] add %s >> %s", rule.Name, rule.Group)
+		writeJSON(w, http.StatusOK, rule)
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		ok, err := a.overlay.remove(name)
+		switch {
+		case err != nil && !ok:
+			writeJSON(w, http.StatusBadRequest, adminError{err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, adminError{err.Error()})
+		case !ok:
+			writeJSON(w, http.StatusNotFound, adminError{"no rule for " + name})
+		default:
+			log.Infof("[Overlay] remove %s", name)
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{http.StatusText(http.StatusMethodNotAllowed)})
+	}
+}
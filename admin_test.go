@@ -0,0 +1,128 @@
+package turned
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminRules(t *testing.T) {
+	inside := New()
+	inside.groupName = "inside"
+	inside.from = "inside.example."
+	final := New()
+	nodes := []*Forward{inside, final}
+
+	a := newAdminServer()
+	a.addr = "127.0.0.1:0"
+	a.token = "secret"
+	a.overlay.file = filepath.Join(t.TempDir(), "overlay.json")
+	if err := a.setup(nodes); err != nil {
+		t.Fatal(err)
+	}
+	app := &Turned{Nodes: nodes, overlay: a.overlay}
+
+	do := func(method, target, body, token string) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		a.mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := do(http.MethodPost, "/rules", `{"name":"*.example.com","group":"final"}`, "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("POST with a wrong token = %d, want %d", code, http.StatusUnauthorized)
+	}
+	bare := httptest.NewRequest(http.MethodGet, "/rules", nil)
+	bare.Header.Set("Authorization", "secret")
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, bare)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET with a token but no Bearer scheme = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if code := do(http.MethodPost, "/rules", `{"name":"*.example.com","group":"nope"}`, "secret"); code != http.StatusBadRequest {
+		t.Errorf("POST for an unknown group = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := do(http.MethodPost, "/rules", `{"name":"*.Example.com.","group":"inside","ttl":"1h"}`, "secret"); code != http.StatusOK {
+		t.Fatalf("POST = %d, want %d", code, http.StatusOK)
+	}
+	if e := app.explain("www.example.com"); e.Group != "inside" || e.Groups[0].Method != "overlay_wildcard" {
+		t.Errorf("overlay rule not used: %+v", e)
+	}
+
+	// a fresh overlay reloads the persisted rule.
+	reload := newRuleOverlay()
+	reload.file = a.overlay.file
+	reload.nodes = nodes
+	if err := reload.load(); err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := reload.lookup("www.example.com"); f != inside {
+		t.Errorf("persisted rule not reloaded")
+	}
+
+	if code := do(http.MethodDelete, "/rules?name=*.example.com", "", "secret"); code != http.StatusNoContent {
+		t.Errorf("DELETE = %d, want %d", code, http.StatusNoContent)
+	}
+	if code := do(http.MethodDelete, "/rules?name=*.example.com", "", "secret"); code != http.StatusNotFound {
+		t.Errorf("second DELETE = %d, want %d", code, http.StatusNotFound)
+	}
+	if e := app.explain("www.example.com"); e.Group != "final" {
+		t.Errorf("removed rule still used: %+v", e)
+	}
+}
+
+func TestAdminRulesSaveError(t *testing.T) {
+	final := New()
+	a := newAdminServer()
+	a.addr = "127.0.0.1:0"
+	a.token = "secret"
+	if err := a.setup([]*Forward{final}); err != nil {
+		t.Fatal(err)
+	}
+	// the directory of the file doesn't exist, the rules can't be saved.
+	a.overlay.file = filepath.Join(t.TempDir(), "missing", "overlay.json")
+
+	req := httptest.NewRequest(http.MethodPost, "/rules", strings.NewReader(`{"name":"example.com","group":"final"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("POST = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if f, _ := a.overlay.lookup("example.com"); f != nil {
+		t.Error("Expected the rule which couldn't be saved to be dropped")
+	}
+}
+
+func TestAdminRulesRemoveSaveError(t *testing.T) {
+	final := New()
+	a := newAdminServer()
+	a.addr = "127.0.0.1:0"
+	a.token = "secret"
+	if err := a.setup([]*Forward{final}); err != nil {
+		t.Fatal(err)
+	}
+	a.overlay.file = filepath.Join(t.TempDir(), "overlay.json")
+	if _, err := a.overlay.add("example.com", "final", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	// the directory of the file is gone, the removal can't be saved.
+	a.overlay.file = filepath.Join(t.TempDir(), "missing", "overlay.json")
+
+	req := httptest.NewRequest(http.MethodDelete, "/rules?name=example.com", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("DELETE = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if f, _ := a.overlay.lookup("example.com"); f != final {
+		t.Error("Expected the rule which couldn't be removed from the file to be kept")
+	}
+}
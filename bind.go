@@ -0,0 +1,153 @@
+package turned
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+// bindOptions pin the connections to an upstream to a source address, an interface or a firewall mark.
+type bindOptions struct {
+	source net.IP
+	iface  string
+	mark   uint32
+}
+
+func (o *bindOptions) empty() bool {
+	return o.source == nil && o.iface == "" && o.mark == 0
+}
+
+// set sets the option of the directive opt to val.
+func (o *bindOptions) set(opt, val string) error {
+	switch opt {
+	case "bind_source":
+		ip := net.ParseIP(val)
+		if ip == nil {
+			return fmt.Errorf("bind_source: not an IP address: %q", val)
+		}
+		o.source = ip
+	case "bind_interface":
+		o.iface = val
+	case "so_mark":
+		mark, err := strconv.ParseUint(val, 0, 32)
+		if err != nil {
+			return fmt.Errorf("so_mark: %s", err)
+		}
+		o.mark = uint32(mark)
+	}
+	return nil
+}
+
+// parseBind parses `bind_source ADDR [UPSTREAM...]`, `bind_interface IFACE [UPSTREAM...]` and
+// `so_mark MARK [UPSTREAM...]`, without upstreams the option applies to the whole group.
+func parseBind(c *caddy.Controller, f *Forward) error {
+	opt := c.Val()
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	val := c.Val()
+
+	upstreams := c.RemainingArgs()
+	if len(upstreams) == 0 {
+		upstreams = []string{""}
+	}
+	for _, u := range upstreams {
+		addr, err := bindUpstream(u)
+		if err != nil {
+			return fmt.Errorf("%s: %s", opt, err)
+		}
+		if f.bind == nil {
+			f.bind = map[string]*bindOptions{}
+		}
+		o, ok := f.bind[addr]
+		if !ok {
+			o = &bindOptions{}
+			f.bind[addr] = o
+		}
+		if err := o.set(opt, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindUpstream returns the address of the proxy an upstream given to a bind option refers to.
+func bindUpstream(u string) (string, error) {
+	if u == "" {
+		return "", nil
+	}
+	if strings.Contains(strings.TrimPrefix(u, "tls://"), "://") {
+		return "", fmt.Errorf("not supported for %s", u)
+	}
+	return upstreamAddr(u)
+}
+
+// bindOptions returns the options of the upstream addr, they take precedence over the ones of the group.
+func (f *Forward) bindOptions(addr string) bindOptions {
+	var o bindOptions
+	if g, ok := f.bind[""]; ok {
+		o = *g
+	}
+	if u, ok := f.bind[addr]; ok {
+		if u.source != nil {
+			o.source = u.source
+		}
+		if u.iface != "" {
+			o.iface = u.iface
+		}
+		if u.mark != 0 {
+			o.mark = u.mark
+		}
+	}
+	return o
+}
+
+// bindDialer dials the upstream with the bind options applied to the socket.
+type bindDialer struct {
+	opts bindOptions
+}
+
+// newBindDialer returns the dialer for opts, it checks once that the platform and the permissions of the
+// process allow them so an error shows at startup rather than on every query.
+func newBindDialer(opts bindOptions) (*bindDialer, error) {
+	if opts.iface != "" {
+		if _, err := net.InterfaceByName(opts.iface); err != nil {
+			return nil, fmt.Errorf("bind_interface %s: %s", opts.iface, err)
+		}
+	}
+
+	addr := ":0"
+	if opts.source != nil {
+		addr = net.JoinHostPort(opts.source.String(), "0")
+	}
+	lc := net.ListenConfig{Control: opts.control}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		if opts.source != nil {
+			return nil, fmt.Errorf("bind_source %s: %s", opts.source, err)
+		}
+		return nil, err
+	}
+	pc.Close()
+
+	return &bindDialer{opts: opts}, nil
+}
+
+func (b *bindDialer) Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	d := &net.Dialer{Timeout: timeout, Control: b.opts.control}
+	if b.opts.source != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: b.opts.source}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: b.opts.source}
+		}
+	}
+	return d.Dial(network, addr)
+}
+
+func (b *bindDialer) UDP() bool { return true }
@@ -0,0 +1,38 @@
+//go:build linux
+
+package turned
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// control sets SO_BINDTODEVICE and SO_MARK on the socket before it's connected.
+func (o *bindOptions) control(_, _ string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if o.iface != "" {
+			if err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, o.iface); err != nil {
+				err = fmt.Errorf("bind_interface %s: %s%s", o.iface, err, permissionHint(err, "CAP_NET_RAW"))
+				return
+			}
+		}
+		if o.mark != 0 {
+			if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(o.mark)); err != nil {
+				err = fmt.Errorf("so_mark %#x: %s%s", o.mark, err, permissionHint(err, "CAP_NET_ADMIN"))
+			}
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func permissionHint(err error, capability string) string {
+	if errors.Is(err, syscall.EPERM) {
+		return " (requires " + capability + ")"
+	}
+	return ""
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package turned
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// control fails when an option other than bind_source is set, they are Linux only.
+func (o *bindOptions) control(_, _ string, _ syscall.RawConn) error {
+	if o.iface != "" {
+		return fmt.Errorf("bind_interface is not supported on %s", runtime.GOOS)
+	}
+	if o.mark != 0 {
+		return fmt.Errorf("so_mark is not supported on %s", runtime.GOOS)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package turned
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseBind(t *testing.T) {
+	c := caddy.NewTestController("dns", `turned bound {
+		from .
+		to 127.0.0.1 127.0.0.2 tls://127.0.0.3
+		bind_source 127.0.0.1
+		bind_source ::1 127.0.0.2
+		so_mark 0x10 tls://127.0.0.3
+	}`)
+	app, err := parseTurned(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := app.Nodes[0]
+
+	tests := []struct {
+		addr   string
+		source string
+		mark   uint32
+	}{
+		{"127.0.0.1:53", "127.0.0.1", 0},
+		{"127.0.0.2:53", "::1", 0},
+		{"127.0.0.3:853", "127.0.0.1", 0x10},
+	}
+	for _, tt := range tests {
+		o := f.bindOptions(tt.addr)
+		if o.source.String() != tt.source || o.mark != tt.mark {
+			t.Errorf("bindOptions(%s) = %s %#x, want %s %#x", tt.addr, o.source, o.mark, tt.source, tt.mark)
+		}
+	}
+}
+
+func TestParseBindError(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"bind_source 192.0.2", "not an IP address"},
+		{"so_mark mark", "so_mark"},
+		{"bind_interface no-such-if0", "no-such-if0"},
+		{"bind_source 127.0.0.1 127.0.0.9", "unknown upstream"},
+		{"bind_source 127.0.0.1 https://127.0.0.1/dns-query", "not supported"},
+	}
+	for _, tt := range tests {
+		c := caddy.NewTestController("dns", "turned bound {\nfrom .\nto 127.0.0.1\n"+tt.input+"\n}")
+		_, err := parseTurned(c)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.input, tt.err, err)
+		}
+	}
+}
+
+func TestBindSource(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		sources []string
+	)
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		mu.Lock()
+		sources = append(sources, host)
+		mu.Unlock()
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(s.Addr)
+
+	d, err := newBindDialer(bindOptions{source: net.ParseIP("127.0.0.2")})
+	if err != nil {
+		t.Skipf("127.0.0.2 is not usable: %s", err)
+	}
+	p := NewProxy(net.JoinHostPort("127.0.0.1", port), "dns")
+	p.SetDialer(d)
+	p.start(hcInterval)
+	defer p.stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	if _, err := p.Connect(context.Background(), request.Request{W: &test.ResponseWriter{}, Req: m}, options{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.health.Check(p); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sources) != 2 {
+		t.Fatalf("Expected 2 queries, got %d", len(sources))
+	}
+	for _, src := range sources {
+		if src != "127.0.0.2" {
+			t.Errorf("Expected queries from 127.0.0.2, got %s", src)
+		}
+	}
+}
+
+func TestBindMark(t *testing.T) {
+	_, err := newBindDialer(bindOptions{mark: 0x10})
+	if errors.Is(err, syscall.EPERM) || err != nil && strings.Contains(err.Error(), "not supported") {
+		t.Skipf("so_mark is not allowed: %s", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "so_mark 0x10") {
+		t.Errorf("Expected a so_mark error, got %s", err)
+	}
+}
@@ -0,0 +1,331 @@
+package turned
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// minResolveTTL bounds how often a host upstream is resolved again, also after a failure.
+	minResolveTTL = 30 * time.Second
+	// bootstrapTimeout is the timeout of a query to a bootstrap server.
+	bootstrapTimeout = 2 * time.Second
+)
+
+// hostUpstream is an upstream given by host name, like tls://dns.google. The name is resolved through the
+// bootstrap servers of the group and a proxy is created for each of its addresses.
+type hostUpstream struct {
+	trans string
+	name  string
+	port  string
+	url   string // the DoH URL, for https only
+
+	serverName string // given with #, it defaults to tls_servername and then to name
+	weight     int    // given with ^, each of its proxies has it
+	pos        int    // the position of its proxies among the static ones
+
+	proxies []*Proxy
+	ttl     time.Duration
+}
+
+// parseHostUpstream returns the upstream of s when it's given by host name: [dns://|tls://|quic://]name[:port]
+// or an https:// URL.
+func parseHostUpstream(s string) (*hostUpstream, bool) {
+	if strings.HasPrefix(s, transport.HTTPS+"://") {
+		u, err := url.Parse(s)
+		if err != nil || !isHostName(u.Hostname()) {
+			return nil, false
+		}
+		du, err := parseDoHURL(s)
+		if err != nil {
+			return nil, false
+		}
+		port := u.Port()
+		if port == "" {
+			port = transport.HTTPSPort
+		}
+		return &hostUpstream{trans: transport.HTTPS, name: u.Hostname(), port: port, url: du}, true
+	}
+
+	var trans, host, port string
+	if strings.HasPrefix(s, transportQUIC+"://") {
+		trans, host, port = transportQUIC, strings.TrimPrefix(s, transportQUIC+"://"), quicPort
+	} else {
+		trans, host = parse.Transport(s)
+		switch trans {
+		case transport.DNS:
+			port = transport.Port
+		case transport.TLS:
+			port = transport.TLSPort
+		default:
+			return nil, false
+		}
+	}
+
+	name, p, err := net.SplitHostPort(host)
+	if err == nil {
+		port = p
+	} else {
+		name = host
+	}
+	if !isHostName(name) {
+		return nil, false
+	}
+	// a file of upstreams is taken as such.
+	if _, err := os.Stat(s); err == nil {
+		return nil, false
+	}
+	return &hostUpstream{trans: trans, name: name, port: port}, true
+}
+
+// isHostName reports whether s is a domain name, rather than an IP address or a file name.
+func isHostName(s string) bool {
+	if net.ParseIP(s) != nil || !strings.Contains(s, ".") {
+		return false
+	}
+	_, ok := dns.IsDomainName(s)
+	return ok
+}
+
+// parseBootstrap returns the address of a bootstrap server, it must be an IP address, the port defaults
+// to 53.
+func parseBootstrap(s string) (string, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = s, transport.Port
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("bootstrap: not an IP address: %q", s)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// newProxy returns the proxy for the address ip of h.
+func (h *hostUpstream) newProxy(ip net.IP) *Proxy {
+	addr := net.JoinHostPort(ip.String(), h.port)
+	var p *Proxy
+	if h.trans == transport.HTTPS {
+		c := newDoHClient(h.url)
+		c.pin(addr)
+		p = newProxy(addr, h.trans, c)
+	} else {
+		p = NewProxy(addr, h.trans)
+	}
+	p.serverName, p.hostName = h.serverName, h.name
+	if h.weight > 0 {
+		p.weight = h.weight
+	}
+	return p
+}
+
+// resolve looks name up through the bootstrap servers, which are tried in order. It returns the
+// addresses sorted and the smallest TTL of the answers.
+func resolve(servers []string, name string) ([]net.IP, time.Duration, error) {
+	err := fmt.Errorf("%s: no bootstrap server", name)
+	for _, server := range servers {
+		var (
+			ips  []net.IP
+			ttl  uint32
+			qerr error
+		)
+		// the addresses of one family do when the query for the other fails.
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			ret, err := bootstrapQuery(server, name, qtype)
+			if err != nil {
+				if qerr == nil {
+					qerr = err
+				}
+				continue
+			}
+			for _, rr := range ret.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					ips = append(ips, rr.A)
+				case *dns.AAAA:
+					ips = append(ips, rr.AAAA)
+				default:
+					continue
+				}
+				if ttl == 0 || rr.Header().Ttl < ttl {
+					ttl = rr.Header().Ttl
+				}
+			}
+		}
+		if len(ips) == 0 {
+			err = qerr
+			if err == nil {
+				err = fmt.Errorf("%s: no address from bootstrap %s", name, server)
+			}
+			continue
+		}
+		sort.Slice(ips, func(i, j int) bool { return ips[i].String() < ips[j].String() })
+		return ips, time.Duration(ttl) * time.Second, nil
+	}
+	return nil, 0, err
+}
+
+// bootstrapQuery sends a query for name to server, over TCP again when the reply is truncated.
+func bootstrapQuery(server, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+
+	c := &dns.Client{Timeout: bootstrapTimeout}
+	ret, _, err := c.Exchange(m, server)
+	if err == nil && ret.Truncated {
+		c.Net = "tcp"
+		ret, _, err = c.Exchange(m, server)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: bootstrap %s: %s", name, server, err)
+	}
+	if ret.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s: bootstrap %s: %s", name, server, dns.RcodeToString[ret.Rcode])
+	}
+	return ret, nil
+}
+
+// resolveHosts creates the proxies of the host upstreams, it runs while the group is set up. A name that
+// doesn't resolve has no proxies until refresh resolves it.
+func (f *Forward) resolveHosts() error {
+	if len(f.hosts) == 0 {
+		return nil
+	}
+	if f.static == nil {
+		f.static = f.proxies
+	}
+
+	for _, h := range f.hosts {
+		if len(f.bootstrap) == 0 {
+			if h.trans != transport.HTTPS {
+				return fmt.Errorf("%s://%s needs bootstrap servers to be resolved", h.trans, h.name)
+			}
+			// without bootstrap the DoH client resolves the name itself.
+			p := NewProxy(h.url, transport.HTTPS)
+			if h.weight > 0 {
+				p.weight = h.weight
+			}
+			h.proxies = []*Proxy{p}
+			continue
+		}
+
+		ips, ttl, err := resolve(f.bootstrap, h.name)
+		if err != nil {
+			// the group starts without the upstream, refresh resolves it again.
+			log.Warningf("[Bootstrap] %s", err)
+			continue
+		}
+		h.ttl = ttl
+		for _, ip := range ips {
+			h.proxies = append(h.proxies, h.newProxy(ip))
+		}
+		log.Infof("[Bootstrap] %s resolved to %v", h.name, ips)
+	}
+	f.proxies = f.assemble()
+	return nil
+}
+
+// assemble returns the static proxies with the ones of the host upstreams at their position.
+func (f *Forward) assemble() []*Proxy {
+	proxies := make([]*Proxy, 0, len(f.static)+len(f.hosts))
+	i := 0
+	for _, h := range f.hosts {
+		proxies = append(proxies, f.static[i:h.pos]...)
+		proxies = append(proxies, h.proxies...)
+		i = h.pos
+	}
+	return append(proxies, f.static[i:]...)
+}
+
+// startResolving resolves the host upstreams again each time their TTL expires.
+func (f *Forward) startResolving() {
+	if len(f.bootstrap) == 0 || len(f.hosts) == 0 {
+		return
+	}
+	f.stopHosts = make(chan struct{})
+	for _, h := range f.hosts {
+		go f.refresh(h, f.stopHosts)
+	}
+}
+
+func (f *Forward) stopResolving() {
+	if f.stopHosts != nil {
+		close(f.stopHosts)
+		f.stopHosts = nil
+	}
+}
+
+func (f *Forward) refresh(h *hostUpstream, stop chan struct{}) {
+	ttl := h.ttl
+	for {
+		if ttl < minResolveTTL {
+			ttl = minResolveTTL
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(ttl):
+		}
+
+		ips, newTTL, err := resolve(f.bootstrap, h.name)
+		if err != nil {
+			// keep the current addresses until the name resolves again.
+			log.Warningf("[Bootstrap] %s", err)
+			ttl = minResolveTTL
+			continue
+		}
+		ttl = newTTL
+		if err := f.update(h, ips); err != nil {
+			log.Warningf("[Bootstrap] %s: %s", h.name, err)
+		}
+	}
+}
+
+// update replaces the proxies of h by the ones of ips, the proxies of the addresses already known are kept.
+func (f *Forward) update(h *hostUpstream, ips []net.IP) error {
+	old := make(map[string]*Proxy, len(h.proxies))
+	for _, p := range h.proxies {
+		old[p.addr] = p
+	}
+
+	var proxies, added []*Proxy
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), h.port)
+		if p, ok := old[addr]; ok {
+			proxies = append(proxies, p)
+			delete(old, addr)
+			continue
+		}
+		p := h.newProxy(ip)
+		if err := f.setupProxy(p); err != nil {
+			return err
+		}
+		proxies = append(proxies, p)
+		added = append(added, p)
+	}
+	if len(added) == 0 && len(old) == 0 {
+		return nil
+	}
+
+	for _, p := range added {
+		p.start(f.hcInterval)
+	}
+	f.mu.Lock()
+	h.proxies = proxies
+	f.proxies = f.assemble()
+	f.mu.Unlock()
+	for _, p := range old {
+		p.stop()
+	}
+	log.Infof("[Bootstrap] %s resolved to %v", h.name, ips)
+	return nil
+}
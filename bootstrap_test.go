@@ -0,0 +1,193 @@
+package turned
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func newBootstrapServer(t *testing.T) string {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name == "dns.example." {
+			switch r.Question[0].Qtype {
+			case dns.TypeA:
+				ret.Answer = append(ret.Answer, test.A("dns.example. 300 IN A 127.0.0.2"), test.A("dns.example. 60 IN A 127.0.0.1"))
+			case dns.TypeAAAA:
+				ret.Answer = append(ret.Answer, test.AAAA("dns.example. 120 IN AAAA ::1"))
+			}
+		} else if r.Question[0].Name == "v4.example." {
+			if r.Question[0].Qtype == dns.TypeA {
+				ret.Answer = append(ret.Answer, test.A("v4.example. 300 IN A 127.0.0.4"))
+			} else {
+				ret.Rcode = dns.RcodeServerFailure
+			}
+		} else if r.Question[0].Name == "v6.example." {
+			if r.Question[0].Qtype == dns.TypeAAAA {
+				ret.Answer = append(ret.Answer, test.AAAA("v6.example. 300 IN AAAA ::6"))
+			} else {
+				ret.Rcode = dns.RcodeServerFailure
+			}
+		} else {
+			ret.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(ret)
+	})
+	t.Cleanup(s.Close)
+	return s.Addr
+}
+
+func TestBootstrap(t *testing.T) {
+	bootstrap := newBootstrapServer(t)
+
+	c := caddy.NewTestController("dns", fmt.Sprintf(`turned hosts {
+		from .
+		to 192.0.2.1 tls://dns.example 192.0.2.2 dns.example:5353
+		bootstrap %s
+	}`, bootstrap))
+	app, err := parseTurned(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := app.Nodes[0]
+
+	var addrs []string
+	for _, p := range f.upstreams() {
+		addrs = append(addrs, p.addr)
+	}
+	expected := "192.0.2.1:53 127.0.0.1:853 127.0.0.2:853 [::1]:853 192.0.2.2:53 127.0.0.1:5353 127.0.0.2:5353 [::1]:5353"
+	if got := strings.Join(addrs, " "); got != expected {
+		t.Errorf("Expected proxies %s, got %s", expected, got)
+	}
+
+	for _, p := range f.hosts[0].proxies {
+		if sni := p.transport.tlsConfig.ServerName; sni != "dns.example" {
+			t.Errorf("Expected server name dns.example for %s, got %q", p.addr, sni)
+		}
+	}
+	if ttl := f.hosts[0].ttl.String(); ttl != "1m0s" {
+		t.Errorf("Expected the smallest TTL 1m0s, got %s", ttl)
+	}
+
+	// 127.0.0.1 is kept, 127.0.0.3 replaces the others.
+	h := f.hosts[0]
+	kept := h.proxies[0]
+	if err := f.update(h, []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.3")}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, p := range f.upstreams() {
+			p.stop()
+		}
+	}()
+	if len(h.proxies) != 2 || h.proxies[0] != kept || h.proxies[1].addr != "127.0.0.3:853" {
+		t.Errorf("Unexpected proxies after update: %v", h.proxies)
+	}
+	if n := f.Len(); n != 7 {
+		t.Errorf("Expected 7 proxies after update, got %d", n)
+	}
+	if p := f.upstreams()[2]; p.addr != "127.0.0.3:853" {
+		t.Errorf("Expected 127.0.0.3:853 in the place of the host upstream, got %s", p.addr)
+	}
+}
+
+func TestBootstrapError(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"to tls://dns.example", "needs bootstrap"},
+		{"to tls://dns.example\nbootstrap dns.google", "not an IP address"},
+	}
+	for _, tt := range tests {
+		c := caddy.NewTestController("dns", "turned hosts {\nfrom .\n"+tt.input+"\n}")
+		_, err := parseTurned(c)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.input, tt.err, err)
+		}
+	}
+}
+
+func TestBootstrapOneFamily(t *testing.T) {
+	bootstrap := newBootstrapServer(t)
+
+	// the query for the other family fails.
+	tests := []struct {
+		name string
+		ip   string
+	}{
+		{"v4.example", "127.0.0.4"},
+		{"v6.example", "::6"},
+	}
+	for _, tc := range tests {
+		ips, _, err := resolve([]string{bootstrap}, tc.name)
+		if err != nil {
+			t.Fatalf("%s: expected the address despite the failed query, got %s", tc.name, err)
+		}
+		if len(ips) != 1 || ips[0].String() != tc.ip {
+			t.Errorf("%s: expected %s, got %v", tc.name, tc.ip, ips)
+		}
+	}
+}
+
+func TestBootstrapUnresolved(t *testing.T) {
+	bootstrap := newBootstrapServer(t)
+
+	c := caddy.NewTestController("dns", "turned hosts {\nfrom .\nto tls://unknown.example\nbootstrap "+bootstrap+"\n}")
+	app, err := parseTurned(c)
+	if err != nil {
+		t.Fatalf("Expected the group to start without the upstream, got %s", err)
+	}
+	f := app.Nodes[0]
+	if n := f.Len(); n != 0 {
+		t.Fatalf("Expected no proxy, got %d", n)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	if _, err := app.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter{}), m); err != ErrNoHealthy {
+		t.Errorf("Expected %s, got %v", ErrNoHealthy, err)
+	}
+
+	// the upstream is added once the name resolves.
+	if err := f.update(f.hosts[0], []net.IP{net.ParseIP("127.0.0.1")}); err != nil {
+		t.Fatal(err)
+	}
+	defer f.upstreams()[0].stop()
+	if n := f.Len(); n != 1 {
+		t.Errorf("Expected 1 proxy once resolved, got %d", n)
+	}
+}
+
+func TestBootstrapServerName(t *testing.T) {
+	bootstrap := newBootstrapServer(t)
+
+	tests := []struct {
+		to, tlsServerName, want string
+	}{
+		{"tls://dns.example", "", "dns.example"},
+		{"tls://dns.example", "\ntls_servername dns.quad9.net", "dns.quad9.net"},
+		{`"tls://dns.example#dns.google"`, "\ntls_servername dns.quad9.net", "dns.google"},
+	}
+	for _, tt := range tests {
+		c := caddy.NewTestController("dns", "turned hosts {\nfrom .\nto "+tt.to+"\nbootstrap "+bootstrap+tt.tlsServerName+"\n}")
+		app, err := parseTurned(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range app.Nodes[0].upstreams() {
+			if sni := p.transport.tlsConfig.ServerName; sni != tt.want {
+				t.Errorf("%s%s: expected server name %s for %s, got %q", tt.to, tt.tlsServerName, tt.want, p.addr, sni)
+			}
+		}
+	}
+}
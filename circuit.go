@@ -0,0 +1,202 @@
+package turned
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerBackoff    = time.Second
+	defaultBreakerMaxBackoff = time.Minute
+	// breakerSlowStart is how long the traffic to an upstream takes to ramp up once its circuit closed again.
+	breakerSlowStart = 10 * time.Second
+	// breakerTrialShare is the share of the queries let through a half-open circuit, the slow start
+	// begins with it as well.
+	breakerTrialShare = 0.1
+)
+
+type breakerState int
+
+const (
+	breakerUp breakerState = iota
+	breakerHalfOpen
+	breakerDown
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half_open"
+	case breakerDown:
+		return "down"
+	}
+	return "up"
+}
+
+var breakerStates = []breakerState{breakerUp, breakerHalfOpen, breakerDown}
+
+// breaker is the circuit breaker of an upstream, driven by the queries rather than the health checks. It
+// opens after threshold failures in a row and half-opens after a backoff doubling each time it opens
+// again, with jitter. A half-open circuit lets a share of the queries through, the first success closes
+// it and the traffic ramps up over breakerSlowStart, a failure opens it again.
+type breaker struct {
+	addr       string
+	threshold  int // 0 disables the breaker
+	backoff    time.Duration
+	maxBackoff time.Duration
+	slowStart  time.Duration
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int       // in a row
+	opens     int       // in a row, for the backoff
+	retry     time.Time // when the open circuit half-opens
+	recovered time.Time // when the circuit closed again
+}
+
+// set configures the breaker of the upstream addr.
+func (b *breaker) set(addr string, threshold int, backoff, maxBackoff time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.addr, b.threshold, b.backoff, b.maxBackoff, b.slowStart = addr, threshold, backoff, maxBackoff, breakerSlowStart
+	if threshold > 0 {
+		b.setState(breakerUp)
+	}
+}
+
+// allow reports whether a query may be sent, the half-open circuit and the slow start let only a share of
+// them through.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold == 0 {
+		return true
+	}
+
+	share := 1.0
+	switch b.state {
+	case breakerDown:
+		if time.Now().Before(b.retry) {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		share = breakerTrialShare
+	case breakerHalfOpen:
+		share = breakerTrialShare
+	case breakerUp:
+		if since := time.Since(b.recovered); since < b.slowStart {
+			share = breakerTrialShare + (1-breakerTrialShare)*float64(since)/float64(b.slowStart)
+		}
+	}
+	return share >= 1 || rand.Float64() < share
+}
+
+// record adds the outcome of a query.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold == 0 {
+		return
+	}
+
+	if err == nil {
+		b.failures = 0
+		if b.state != breakerUp {
+			b.opens = 0
+			b.recovered = time.Now()
+			b.setState(breakerUp)
+		}
+		return
+	}
+
+	b.failures++
+	switch b.state {
+	case breakerUp:
+		if b.failures >= b.threshold {
+			b.open()
+		}
+	case breakerHalfOpen:
+		b.open()
+	}
+}
+
+// open opens the circuit for the backoff, b.mu must be held.
+func (b *breaker) open() {
+	b.opens++
+	d := b.backoff
+	for i := 1; i < b.opens && d < b.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > b.maxBackoff {
+		d = b.maxBackoff
+	}
+	// the upstreams which failed together don't half-open together.
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	b.retry = time.Now().Add(d)
+	b.setState(breakerDown)
+	log.Warningf("Circuit of %s open for %s after %d failed queries", b.addr, d, b.failures)
+}
+
+// setState sets the state of the circuit and its gauge, b.mu must be held.
+func (b *breaker) setState(state breakerState) {
+	b.state = state
+	for _, s := range breakerStates {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		CircuitStateGauge.WithLabelValues(b.addr, s.String()).Set(v)
+	}
+}
+
+// current returns the state of the circuit, an open circuit past its backoff is half-open.
+func (b *breaker) current() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerDown && !time.Now().Before(b.retry) {
+		return breakerHalfOpen
+	}
+	return b.state
+}
+
+// breakerOptions are the circuit_breaker settings of a group.
+type breakerOptions struct {
+	threshold  int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// parseBreaker parses circuit_breaker FAILURES [BACKOFF [MAX_BACKOFF]].
+func parseBreaker(args []string) (breakerOptions, error) {
+	opts := breakerOptions{backoff: defaultBreakerBackoff, maxBackoff: defaultBreakerMaxBackoff}
+	if len(args) == 0 || len(args) > 3 {
+		return opts, fmt.Errorf("circuit_breaker FAILURES [BACKOFF [MAX_BACKOFF]] expected: %v", args)
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		return opts, err
+	}
+	if n < 1 {
+		return opts, fmt.Errorf("circuit_breaker needs at least one failure: %d", n)
+	}
+	opts.threshold = n
+
+	durations := []*time.Duration{&opts.backoff, &opts.maxBackoff}
+	for i, arg := range args[1:] {
+		dur, err := time.ParseDuration(arg)
+		if err != nil {
+			return opts, err
+		}
+		if dur <= 0 {
+			return opts, fmt.Errorf("circuit_breaker backoff must be positive: %s", dur)
+		}
+		*durations[i] = dur
+	}
+	if opts.maxBackoff < opts.backoff {
+		return opts, fmt.Errorf("circuit_breaker max backoff %s below the backoff %s", opts.maxBackoff, opts.backoff)
+	}
+	return opts, nil
+}
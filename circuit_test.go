@@ -0,0 +1,228 @@
+package turned
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var errQuery = errors.New("query failed")
+
+func TestBreaker(t *testing.T) {
+	p := NewProxy("10.0.0.1:53", "dns")
+	p.SetCircuitBreaker(3, 20*time.Millisecond, 20*time.Millisecond)
+	b := &p.breaker
+	gauge := func(s breakerState) float64 {
+		return testutil.ToFloat64(CircuitStateGauge.WithLabelValues(p.addr, s.String()))
+	}
+
+	b.record(errQuery)
+	b.record(errQuery)
+	b.record(nil) // a success in between starts over
+	b.record(errQuery)
+	b.record(errQuery)
+	if p.Down(0) || b.current() != breakerUp || gauge(breakerUp) != 1 {
+		t.Fatal("Expected the circuit to be closed")
+	}
+	b.record(errQuery)
+	if !p.Down(0) || b.current() != breakerDown || gauge(breakerDown) != 1 || gauge(breakerUp) != 0 {
+		t.Fatal("Expected the circuit to open after 3 failures")
+	}
+	if s := p.Stats(); s.Circuit != "down" {
+		t.Errorf("Expected the stats to show the open circuit, got %s", s.Circuit)
+	}
+
+	// half-open after the backoff, a failure opens it again.
+	time.Sleep(25 * time.Millisecond)
+	b.allow()
+	if b.current() != breakerHalfOpen || gauge(breakerHalfOpen) != 1 {
+		t.Fatal("Expected the circuit to half-open after the backoff")
+	}
+	b.record(errQuery)
+	if b.current() != breakerDown {
+		t.Fatal("Expected a failure to open the half-open circuit")
+	}
+
+	// a success closes it, the traffic ramps up from the trial share.
+	time.Sleep(25 * time.Millisecond)
+	b.allow()
+	b.slowStart = time.Hour
+	b.record(nil)
+	if b.current() != breakerUp || gauge(breakerUp) != 1 {
+		t.Fatal("Expected a success to close the circuit")
+	}
+	allowed := 0
+	const n = 2000
+	for i := 0; i < n; i++ {
+		if b.allow() {
+			allowed++
+		}
+	}
+	if share := float64(allowed) / n; share < breakerTrialShare/2 || share > breakerTrialShare*2 {
+		t.Errorf("Expected about %.0f%% of the queries during the slow start, got %.1f%%", breakerTrialShare*100, share*100)
+	}
+}
+
+func TestBreakerBackoff(t *testing.T) {
+	var b breaker
+	b.set("10.0.0.2:53", 1, 100*time.Millisecond, 300*time.Millisecond)
+
+	for _, d := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond} {
+		b.record(errQuery)
+		b.mu.Lock()
+		wait := time.Until(b.retry)
+		// half-open right away for the next round.
+		b.retry = time.Now()
+		b.mu.Unlock()
+		if wait < d/2-10*time.Millisecond || wait > d {
+			t.Errorf("Expected a backoff between %s and %s, got %s", d/2, d, wait)
+		}
+		b.allow()
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	p := NewProxy("10.0.0.3:53", "dns")
+	for i := 0; i < 100; i++ {
+		p.breaker.record(errQuery)
+	}
+	if p.Down(0) {
+		t.Error("Expected no circuit breaker by default")
+	}
+}
+
+func TestBreakerForward(t *testing.T) {
+	fast := newDelayedServer(t, "192.0.2.2", 0)
+	closed := closedAddr(t)
+	app := newTestApp(t, "policy sequential\nmax_fails 0\ncircuit_breaker 2 1m", closed, fast)
+	first := app.Nodes[0].proxies[0]
+
+	for i := 0; i < 4; i++ {
+		ret, _, err := testQuery(app)
+		if err != nil || answerIP(ret) != "192.0.2.2" {
+			t.Fatalf("Expected the second upstream to answer, got %v", err)
+		}
+	}
+	if s := first.Stats(); s.Circuit != "down" {
+		t.Errorf("Expected the circuit of %s to be open, got %s", closed, s.Circuit)
+	}
+	// the health checks don't close it.
+	first.health.Check(first)
+	if !first.Down(0) {
+		t.Error("Expected the upstream to stay down")
+	}
+}
+
+func TestBreakerDownReadOnly(t *testing.T) {
+	p := NewProxy("10.0.0.4:53", "dns")
+	p.SetCircuitBreaker(1, 10*time.Millisecond, 10*time.Millisecond)
+	b := &p.breaker
+
+	b.record(errQuery)
+	time.Sleep(15 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		if p.Down(0) {
+			t.Fatal("Expected the circuit past its backoff not to be down")
+		}
+	}
+	b.mu.Lock()
+	state := b.state
+	b.mu.Unlock()
+	if state != breakerDown {
+		t.Errorf("Expected Down to leave the circuit open until a query is let through, got %s", state)
+	}
+
+	// a query closes it, Down doesn't hold any back during the slow start.
+	b.allow()
+	b.record(nil)
+	for i := 0; i < 100; i++ {
+		if p.Down(0) {
+			t.Fatal("Expected the upstream up during the slow start")
+		}
+	}
+}
+
+func TestBreakerAllOpen(t *testing.T) {
+	var udp, tcp int32
+	app := newTestApp(t, "circuit_breaker 1 1m", newViaUpstream(t, &udp, &tcp))
+	p := app.Nodes[0].proxies[0]
+	p.breaker.record(errQuery)
+	broken := testutil.ToFloat64(HealthcheckBrokenCount)
+
+	if _, _, err := testQuery(app); err == nil {
+		t.Error("Expected an error with the only circuit open")
+	}
+	if n := atomic.LoadInt32(&udp) + atomic.LoadInt32(&tcp); n != 0 {
+		t.Errorf("Expected no query sent to the upstream, got %d", n)
+	}
+	if n := testutil.ToFloat64(HealthcheckBrokenCount); n != broken {
+		t.Error("Expected the open circuit not to count as broken health checks")
+	}
+}
+
+func TestBreakerCanceled(t *testing.T) {
+	var h2 int32
+	fast := newDelayedDoHServer(t, "192.0.2.2", 0, &h2)
+	slow := newDelayedDoHServer(t, "192.0.2.1", 100*time.Millisecond, &h2)
+	ca := dohCA(t, fast)
+
+	// the queries to the slow upstream are canceled once the fast one answered.
+	tests := []struct {
+		name      string
+		options   string
+		upstreams []string
+	}{
+		{"race", "policy race 2", []string{fast.URL, slow.URL}},
+		{"hedge", "policy sequential\nhedge 20ms", []string{slow.URL, fast.URL}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			app := newTestApp(t, tc.options+"\ncircuit_breaker 3 1m\ntls "+ca, tc.upstreams...)
+			for i := 0; i < 5; i++ {
+				if ret, _, err := testQuery(app); answerIP(ret) != "192.0.2.2" {
+					t.Fatalf("Expected the fast upstream to answer, got %v %v", ret, err)
+				}
+			}
+			for _, p := range app.Nodes[0].proxies {
+				if st := p.Stats(); st.Circuit != "up" {
+					t.Errorf("Expected the circuit of %s to stay up, got %s", st.Addr, st.Circuit)
+				}
+			}
+		})
+	}
+}
+
+func TestParseCircuitBreaker(t *testing.T) {
+	tests := []struct {
+		args string
+		want breakerOptions
+		err  bool
+	}{
+		{"5", breakerOptions{5, defaultBreakerBackoff, defaultBreakerMaxBackoff}, false},
+		{"5 2s 30s", breakerOptions{5, 2 * time.Second, 30 * time.Second}, false},
+		{"", breakerOptions{}, true},
+		{"0", breakerOptions{}, true},
+		{"5 0s", breakerOptions{}, true},
+		{"5 10s 1s", breakerOptions{}, true},
+	}
+	for _, tc := range tests {
+		app, err := parseTurned(caddy.NewTestController("dns", "turned cb {\nto 1.1.1.1\ncircuit_breaker "+tc.args+"\n}"))
+		if tc.err {
+			if err == nil {
+				t.Errorf("Expected an error for %q", tc.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", tc.args, err)
+		}
+		if got := app.Nodes[0].breaker; got != tc.want {
+			t.Errorf("Expected %+v for %q, got %+v", tc.want, tc.args, got)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -18,21 +20,21 @@ import (
 	"github.com/swoiow/blocked/parsers"
 )
 
-func parseTurned(c *caddy.Controller) ([]*Forward, error) {
+func parseTurned(c *caddy.Controller) (*Turned, error) {
 	var (
 		f   *Forward
 		err error
 		// i   int
-		bucket []*Forward
+		app = &Turned{}
 	)
 
 	for c.Next() {
-		f, err = parseForward(c)
+		f, err = parseForward(c, app)
 		if err != nil {
 			return nil, err
 		}
 
-		bucket = append(bucket, f)
+		app.Nodes = append(app.Nodes, f)
 
 		mode := "-"
 		count := "-"
@@ -49,10 +51,19 @@ func parseTurned(c *caddy.Controller) ([]*Forward, error) {
 			log.Infof("[Settings] config node >> name:%s mode:%s count:%s", f.groupName, mode, count)
 		}
 	}
-	return bucket, nil
+
+	app.shareProxies()
+
+	if app.admin != nil {
+		if err := app.admin.setup(app.Nodes); err != nil {
+			return nil, err
+		}
+		app.overlay = app.admin.overlay
+	}
+	return app, nil
 }
 
-func parseForward(c *caddy.Controller) (*Forward, error) {
+func parseForward(c *caddy.Controller, app *Turned) (*Forward, error) {
 	f := New()
 
 	if !c.Args(&f.groupName) {
@@ -68,14 +79,356 @@ func parseForward(c *caddy.Controller) (*Forward, error) {
 	}
 
 	for c.NextBlock() {
+		ok, err := parseGlobal(c, app)
+		if err != nil {
+			return f, err
+		}
+		if ok {
+			continue
+		}
 		if err := parseBlock(c, f); err != nil {
 			return f, err
 		}
 	}
+	if err := f.setupProxies(); err != nil {
+		return f, err
+	}
 
 	return f, nil
 }
 
+// parseTo creates a proxy for each upstream given to `to`.
+func parseTo(f *Forward, to []string) error {
+	for _, host := range to {
+		host, weight, err := cutWeight(host)
+		if err != nil {
+			return err
+		}
+		proxies, hosts := len(f.proxies), len(f.hosts)
+		if err := parseUpstream(f, host); err != nil {
+			return err
+		}
+		for _, p := range f.proxies[proxies:] {
+			p.weight = weight
+		}
+		for _, h := range f.hosts[hosts:] {
+			h.weight = weight
+		}
+	}
+	return nil
+}
+
+// parseUpstream adds the proxies of the upstream host, or its host upstream when given by host name.
+func parseUpstream(f *Forward, host string) error {
+	if strings.HasPrefix(host, transportUnix+"://") {
+		path := strings.TrimPrefix(host, transportUnix+"://")
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("not an absolute socket path: %s", host)
+		}
+		f.proxies = append(f.proxies, NewProxy(path, transportUnix))
+		return nil
+	}
+	host, serverName, err := cutServerName(host)
+	if err != nil {
+		return err
+	}
+	if h, ok := parseHostUpstream(host); ok {
+		h.pos = len(f.proxies)
+		h.serverName = serverName
+		f.hosts = append(f.hosts, h)
+		return nil
+	}
+	if strings.HasPrefix(host, transport.HTTPS+"://") {
+		u, err := parseDoHURL(host)
+		if err != nil {
+			return err
+		}
+		f.proxies = append(f.proxies, NewProxy(u, transport.HTTPS))
+		return nil
+	}
+	if strings.HasPrefix(host, transportDNSCrypt+"://") {
+		stamp, err := parseDNSCryptStamp(host)
+		if err != nil {
+			return err
+		}
+		f.proxies = append(f.proxies, newProxy(stamp.ServerAddrStr, transportDNSCrypt, newDNSCryptClient(stamp)))
+		return nil
+	}
+	if strings.HasPrefix(host, transportQUIC+"://") {
+		addr, err := parseQUICAddr(host)
+		if err != nil {
+			return err
+		}
+		p := NewProxy(addr, transportQUIC)
+		p.serverName = serverName
+		f.proxies = append(f.proxies, p)
+		return nil
+	}
+
+	toHosts, err := parse.HostPortOrFile(host)
+	if err != nil {
+		return err
+	}
+	allowedTrans := map[string]bool{transport.DNS: true, transport.TLS: true, transport.GRPC: true}
+	for _, h := range toHosts {
+		trans, addr := parse.Transport(h)
+		if !allowedTrans[trans] {
+			return fmt.Errorf("'%s' is not supported as a destination protocol in forward: %s", trans, h)
+		}
+		p := NewProxy(addr, trans)
+		p.serverName = serverName
+		f.proxies = append(f.proxies, p)
+	}
+	return nil
+}
+
+// cutWeight splits the weight off an upstream written ADDR^N, for policy weighted. It defaults to 1.
+func cutWeight(host string) (string, int, error) {
+	i := strings.LastIndexByte(host, '^')
+	if i < 0 {
+		return host, 1, nil
+	}
+	weight, err := strconv.Atoi(host[i+1:])
+	if err != nil || weight < 1 {
+		return "", 0, fmt.Errorf("invalid weight, a positive integer is expected: %s", host)
+	}
+	return host[:i], weight, nil
+}
+
+// cutServerName splits the TLS server name off an upstream written tls://ADDR#NAME or quic://ADDR#NAME.
+func cutServerName(host string) (string, string, error) {
+	if strings.HasPrefix(host, transport.HTTPS+"://") {
+		// # starts the fragment of a URL.
+		return host, "", nil
+	}
+	host, serverName, ok := strings.Cut(host, "#")
+	if !ok {
+		return host, "", nil
+	}
+	if !strings.HasPrefix(host, transport.TLS+"://") && !strings.HasPrefix(host, transportQUIC+"://") {
+		return "", "", fmt.Errorf("a server name is only supported for tls:// and quic:// upstreams: %s#%s", host, serverName)
+	}
+	if serverName == "" {
+		return "", "", fmt.Errorf("empty server name: %s#", host)
+	}
+	return host, serverName, nil
+}
+
+// upstreamAddr returns the address of the proxy an upstream, written like in `to`, refers to.
+func upstreamAddr(u string) (string, error) {
+	u, _, err := cutServerName(u)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasPrefix(u, transport.HTTPS+"://"):
+		return parseDoHURL(u)
+	case strings.HasPrefix(u, transportQUIC+"://"):
+		return parseQUICAddr(u)
+	}
+
+	hosts, err := parse.HostPortOrFile(u)
+	if err != nil {
+		return "", err
+	}
+	if len(hosts) != 1 {
+		return "", fmt.Errorf("not a single upstream: %s", u)
+	}
+	_, addr := parse.Transport(hosts[0])
+	return addr, nil
+}
+
+// setupProxies applies the settings of the group to its proxies, it runs once the whole block is parsed
+// so the order of the properties doesn't matter.
+func (f *Forward) setupProxies() error {
+	if f.tlsServerName != "" {
+		f.tlsConfig.ServerName = f.tlsServerName
+	}
+
+	if f.minIdle > 0 && f.expire <= 0 {
+		return fmt.Errorf("min_idle needs a positive expire")
+	}
+
+	if err := f.resolveHosts(); err != nil {
+		return err
+	}
+
+	// Initialize ClientSessionCache in tls.Config. This may speed up a TLS handshake
+	// in upcoming connections to the same TLS server.
+	f.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(len(f.proxies))
+
+	for _, p := range f.proxies {
+		if err := f.setupProxy(p); err != nil {
+			return err
+		}
+	}
+
+	for addr := range f.bind {
+		if addr != "" && !f.hasUpstream(addr) {
+			return fmt.Errorf("bind options for unknown upstream: %s", addr)
+		}
+	}
+	for addr := range f.pins {
+		if addr != "" && !f.hasUpstream(addr) {
+			return fmt.Errorf("pin for unknown upstream: %s", addr)
+		}
+	}
+	return nil
+}
+
+// setupProxy applies the settings of the group to p.
+func (f *Forward) setupProxy(p *Proxy) error {
+	tlsConfig := f.tlsConfig
+	serverName := p.serverName
+	if serverName == "" && f.tlsServerName == "" {
+		serverName = p.hostName
+	}
+	if serverName != "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = serverName
+	}
+	if p.pins = f.pinsFor(p.addr); p.pins != nil && !p.usesTLS(f.tlsEnabled) {
+		return fmt.Errorf("pin needs a TLS upstream: %s", p.addr)
+	}
+
+	// Only set this for proxies that need it.
+	switch p.trans {
+	case transport.TLS, transportQUIC:
+		p.SetTLSConfig(tlsConfig)
+	case transport.HTTPS:
+		p.SetTLSConfig(tlsConfig)
+		p.exchanger.(*dohClient).method = f.dohMethod
+	case transport.GRPC:
+		// gRPC is plain text unless the group configures TLS.
+		if f.tlsEnabled {
+			p.SetTLSConfig(tlsConfig)
+		}
+	}
+	p.SetExpire(f.expire)
+	p.SetReadTimeout(f.readTimeout)
+	p.SetCircuitBreaker(f.breaker.threshold, f.breaker.backoff, f.breaker.maxBackoff)
+	p.SetDialTimeout(f.dialTimeout)
+	if p.exchanger == nil {
+		if f.pipeline {
+			p.transport.pipeline = newPipeline()
+		}
+		proto := "udp"
+		if f.opts.forceTCP {
+			proto = "tcp"
+		}
+		p.transport.SetMinIdle(f.minIdle, proto)
+	}
+	if p.health != nil {
+		p.health.SetRecursionDesired(f.opts.hcRecursionDesired)
+		probe := f.hcProbe
+		probe.tcp = f.opts.forceTCP
+		p.health.SetProbe(probe)
+	}
+	return f.setupDialer(p)
+}
+
+// setupDialer sets the dialer of p from the bind options and the via proxy of the group.
+func (f *Forward) setupDialer(p *Proxy) error {
+	opts := f.bindOptions(p.addr)
+	if opts.empty() && f.via == "" {
+		return nil
+	}
+	if p.exchanger != nil || p.trans == transportUnix {
+		if f.via != "" {
+			return fmt.Errorf("via is not supported for %s upstreams: %s", p.trans, p.addr)
+		}
+		return fmt.Errorf("bind options are not supported for %s upstreams: %s", p.trans, p.addr)
+	}
+
+	var d dialer = directDialer{}
+	if !opts.empty() {
+		bd, err := newBindDialer(opts)
+		if err != nil {
+			return fmt.Errorf("%s: %s", p.addr, err)
+		}
+		d = bd
+	}
+	if f.via != "" {
+		// the bind options apply to the connections to the proxy.
+		vd, err := newViaDialer(f.via, d)
+		if err != nil {
+			return err
+		}
+		d = vd
+	}
+	p.SetDialer(d)
+	return nil
+}
+
+func (f *Forward) hasUpstream(addr string) bool {
+	for _, p := range f.proxies {
+		if p.addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// parseGlobal handles the properties that configure the whole plugin instead of a single group. They
+// may be written in any group block, it reports whether c.Val() was one of them.
+func parseGlobal(c *caddy.Controller, app *Turned) (bool, error) {
+	switch c.Val() {
+	case "explain_http":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		if app.explainHTTP != nil {
+			return true, c.Errf("explain_http already set to %s", app.explainHTTP.addr)
+		}
+		app.explainHTTP = newExplainServer(c.Val(), app)
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+	case "explain_dns":
+		if app.explainDNS != nil {
+			return true, c.Err("explain_dns already set")
+		}
+		nets := c.RemainingArgs()
+		if len(nets) == 0 {
+			nets = []string{"127.0.0.0/8", "::1/128"}
+		}
+		e, err := newExplainResponder(nets)
+		if err != nil {
+			return true, err
+		}
+		app.explainDNS = e
+	case "admin_http":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		app.adminServer().addr = c.Val()
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+	case "admin_token":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		app.adminServer().token = c.Val()
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+	case "admin_file":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		app.adminServer().overlay.file = c.Val()
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
 func parseBlock(c *caddy.Controller, f *Forward) error {
 	switch c.Val() {
 
@@ -121,6 +474,13 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 			}
 		}
 
+	case "health_query":
+		probe, err := parseHealthProbe(c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		f.hcProbe = probe
+
 	case "edns", "edns_client_subnet":
 		subnets := c.RemainingArgs()
 		if len(subnets) == 0 {
@@ -142,6 +502,11 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 			return c.ArgErr()
 		}
 		f.opts.forceTCP = true
+	case "pipeline":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.pipeline = true
 	case "prefer_udp":
 		if c.NextArg() {
 			return c.ArgErr()
@@ -158,11 +523,65 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 			return err
 		}
 		f.tlsConfig = tlsConfig
+		f.tlsEnabled = true
+		f.tlsArgs = args
+	case "doh_method":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch x := strings.ToUpper(c.Val()); x {
+		case http.MethodGet, http.MethodPost:
+			f.dohMethod = x
+		default:
+			return c.Errf("unknown doh_method '%s'", c.Val())
+		}
+	case "pin":
+		return parsePin(c, f)
+	case "bind_source", "bind_interface", "so_mark":
+		return parseBind(c, f)
+	case "bootstrap":
+		servers := c.RemainingArgs()
+		if len(servers) == 0 {
+			return c.ArgErr()
+		}
+		for _, server := range servers {
+			addr, err := parseBootstrap(server)
+			if err != nil {
+				return err
+			}
+			f.bootstrap = append(f.bootstrap, addr)
+		}
+	case "via":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if _, err := newViaDialer(c.Val(), directDialer{}); err != nil {
+			return err
+		}
+		f.via = c.Val()
+		if c.NextArg() {
+			return c.ArgErr()
+		}
 	case "tls_servername":
 		if !c.NextArg() {
 			return c.ArgErr()
 		}
 		f.tlsServerName = c.Val()
+	case "min_idle":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("min_idle can't be negative: %d", n)
+		}
+		f.minIdle = n
+		if c.NextArg() {
+			return c.ArgErr()
+		}
 	case "expire":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -175,20 +594,72 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 			return fmt.Errorf("expire can't be negative: %s", dur)
 		}
 		f.expire = dur
+	case "timeout", "dial_timeout":
+		dir := c.Val()
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return fmt.Errorf("%s must be positive: %s", dir, dur)
+		}
+		if dir == "timeout" {
+			f.timeout = dur
+		} else {
+			f.dialTimeout = dur
+		}
+	case "read_timeout":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if c.Val() == "auto" {
+			f.readTimeout = tunedReadTimeout
+			break
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return fmt.Errorf("read_timeout must be positive: %s", dur)
+		}
+		f.readTimeout = dur
+	case "max_attempts":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 1 {
+			return fmt.Errorf("max_attempts must be positive: %d", n)
+		}
+		f.maxAttempts = n
+	case "circuit_breaker":
+		opts, err := parseBreaker(c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		f.breaker = opts
 	case "policy":
 		if !c.NextArg() {
 			return c.ArgErr()
 		}
-		switch x := c.Val(); x {
-		case "random":
-			f.p = &random{}
-		case "round_robin":
-			f.p = &roundRobin{}
-		case "sequential":
-			f.p = &sequential{}
-		default:
-			return c.Errf("unknown policy '%s'", x)
+		p, err := newPolicy(c.Val(), c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
 		}
+		f.p = p
+	case "hedge":
+		h, err := parseHedge(c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		f.hedge = h
 	case "max_concurrent":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -210,41 +681,8 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 			return c.ArgErr()
 		}
 
-		toHosts, err := parse.HostPortOrFile(to...)
-		if err != nil {
-			panic(err)
-			// return f, err
-		}
-
-		transports := make([]string, len(toHosts))
-		allowedTrans := map[string]bool{"dns": true, "tls": true}
-		for i, host := range toHosts {
-			trans, h := parse.Transport(host)
-
-			if !allowedTrans[trans] {
-				panic(fmt.Errorf("'%s' is not supported as a destination protocol in forward: %s", trans, host))
-				// return f, fmt.Errorf("'%s' is not supported as a destination protocol in forward: %s", trans, host)
-			}
-			p := NewProxy(h, trans)
-			f.proxies = append(f.proxies, p)
-			transports[i] = trans
-		}
-
-		if f.tlsServerName != "" {
-			f.tlsConfig.ServerName = f.tlsServerName
-		}
-
-		// Initialize ClientSessionCache in tls.Config. This may speed up a TLS handshake
-		// in upcoming connections to the same TLS server.
-		f.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(len(f.proxies))
-
-		for i := range f.proxies {
-			// Only set this for proxies that need it.
-			if transports[i] == transport.TLS {
-				f.proxies[i].SetTLSConfig(f.tlsConfig)
-			}
-			f.proxies[i].SetExpire(f.expire)
-			f.proxies[i].health.SetRecursionDesired(f.opts.hcRecursionDesired)
+		if err := parseTo(f, to); err != nil {
+			return err
 		}
 
 	case "from":
@@ -312,3 +750,10 @@ const max = 15 // Maximum number of upstreams.
 func PureDomain(s string) string {
 	return utils.PureDomain(s)
 }
+
+func (app *Turned) adminServer() *adminServer {
+	if app.admin == nil {
+		app.admin = newAdminServer()
+	}
+	return app.admin
+}
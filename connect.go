@@ -6,6 +6,7 @@ package turned
 
 import (
 	"context"
+	"errors"
 	"io"
 	"strconv"
 	"sync/atomic"
@@ -36,6 +37,9 @@ func averageTimeout(currentAvg *int64, observedDuration time.Duration, weight in
 }
 
 func (t *Transport) dialTimeout() time.Duration {
+	if t.fixedDialTimeout > 0 {
+		return t.fixedDialTimeout
+	}
 	return limitTimeout(&t.avgDialTime, minDialTimeout, maxDialTimeout)
 }
 
@@ -43,38 +47,105 @@ func (t *Transport) updateDialTimeout(newDialTime time.Duration) {
 	averageTimeout(&t.avgDialTime, newDialTime, cumulativeAvgWeight)
 }
 
-// Dial dials the address configured in transport, potentially reusing a connection or creating a new one.
-func (t *Transport) Dial(proto string) (*persistConn, bool, error) {
+func (t *Transport) updateReadTimeout(newReadTime time.Duration) {
+	averageTimeout(&t.avgReadTime, newReadTime, cumulativeAvgWeight)
+}
+
+// proto returns the protocol the connections of transport use for proto.
+func (t *Transport) proto(proto string) string {
+	if t.unix {
+		return transportUnix
+	}
 	// If tls has been configured; use it.
 	if t.tlsConfig != nil {
-		proto = "tcp-tls"
+		return "tcp-tls"
+	}
+	// The outbound proxy may not carry UDP.
+	if proto == "udp" && !t.dialer.UDP() {
+		return "tcp"
 	}
+	return proto
+}
 
-	t.dial <- proto
-	pc := <-t.ret
+// Dial dials the address configured in transport, potentially reusing a connection or creating a new one.
+func (t *Transport) Dial(proto string) (*persistConn, bool, error) {
+	proto = t.proto(proto)
 
-	if pc != nil {
+	if pc := t.pools[stringToTransportType(proto)].get(t.expire); pc != nil {
 		ConnCacheHitsCount.WithLabelValues(t.addr, proto).Add(1)
 		return pc, true, nil
 	}
 	ConnCacheMissesCount.WithLabelValues(t.addr, proto).Add(1)
 
+	conn, err := t.dialConn(proto, "query")
+	return &persistConn{c: conn}, false, err
+}
+
+// dialConn opens a new connection for proto, reason tells whether a query or min_idle needs it.
+func (t *Transport) dialConn(proto, reason string) (*dns.Conn, error) {
 	reqTime := time.Now()
-	timeout := t.dialTimeout()
-	if proto == "tcp-tls" {
-		conn, err := dns.DialTimeoutWithTLS("tcp", t.addr, t.tlsConfig, timeout)
-		t.updateDialTimeout(time.Since(reqTime))
-		return &persistConn{c: conn}, false, err
-	}
-	conn, err := dns.DialTimeout(proto, t.addr, timeout)
+	conn, err := dialDNS(t.dialer, proto, t.addr, t.tlsConfig, t.dialTimeout())
 	t.updateDialTimeout(time.Since(reqTime))
-	return &persistConn{c: conn}, false, err
+	if err != nil {
+		return nil, err
+	}
+	HandshakeCount.WithLabelValues(t.addr, proto, reason).Add(1)
+	return conn, nil
 }
 
 // Connect selects an upstream, sends the request and waits for a response.
 func (p *Proxy) Connect(ctx context.Context, state request.Request, opts options) (*dns.Msg, error) {
 	start := time.Now()
 
+	var (
+		ret *dns.Msg
+		err error
+	)
+	timeout := p.queryTimeout()
+	if p.exchanger != nil {
+		ctx, cancel := context.WithTimeout(withReadTimeout(ctx, timeout), maxTimeout+timeout)
+		ret, err = p.exchanger.Exchange(ctx, state.Req)
+		cancel()
+	} else {
+		// the reply isn't waited for past the deadline of the query.
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+			timeout = time.Until(deadline)
+		}
+		if timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		ret, err = p.connect(state, opts, timeout)
+	}
+	// a closed cached connection says nothing about the upstream, the query is sent again. Neither does a
+	// query the caller gave up on, as the ones race and hedge cancel once answered.
+	if err != ErrCachedClosed && !canceled(ctx, err) {
+		p.latency.observe(time.Since(start), err)
+		p.breaker.record(err)
+	}
+	if err != nil {
+		return ret, err
+	}
+	p.transport.updateReadTimeout(time.Since(start))
+
+	rc, ok := dns.RcodeToString[ret.Rcode]
+	if !ok {
+		rc = strconv.Itoa(ret.Rcode)
+	}
+
+	RequestCount.WithLabelValues(p.addr).Add(1)
+	RcodeCount.WithLabelValues(rc, p.addr).Add(1)
+	RequestDuration.WithLabelValues(p.addr, rc).Observe(time.Since(start).Seconds())
+
+	return ret, nil
+}
+
+// canceled reports whether the query failed with err because its caller canceled ctx.
+func canceled(ctx context.Context, err error) bool {
+	return err != nil && (ctx.Err() != nil || errors.Is(err, context.Canceled))
+}
+
+// connect sends the request over a (cached) connection of p.transport and waits timeout for the reply.
+func (p *Proxy) connect(state request.Request, opts options, timeout time.Duration) (*dns.Msg, error) {
 	proto := ""
 	switch {
 	case opts.forceTCP: // TCP flag has precedence over UDP flag
@@ -85,6 +156,16 @@ func (p *Proxy) Connect(ctx context.Context, state request.Request, opts options
 		proto = state.Proto()
 	}
 
+	if pl := p.transport.pipeline; pl != nil {
+		if proto = p.transport.proto(proto); proto != "udp" {
+			pc, cached, err := pl.get(p.transport, proto)
+			if err != nil {
+				return nil, err
+			}
+			return pc.exchange(state.Req, cached, timeout)
+		}
+	}
+
 	pc, cached, err := p.transport.Dial(proto)
 	if err != nil {
 		return nil, err
@@ -106,7 +187,7 @@ func (p *Proxy) Connect(ctx context.Context, state request.Request, opts options
 	}
 
 	var ret *dns.Msg
-	pc.c.SetReadDeadline(time.Now().Add(readTimeout))
+	pc.c.SetReadDeadline(time.Now().Add(timeout))
 	for {
 		ret, err = pc.c.ReadMsg()
 		if err != nil {
@@ -124,15 +205,6 @@ func (p *Proxy) Connect(ctx context.Context, state request.Request, opts options
 
 	p.transport.Yield(pc)
 
-	rc, ok := dns.RcodeToString[ret.Rcode]
-	if !ok {
-		rc = strconv.Itoa(ret.Rcode)
-	}
-
-	RequestCount.WithLabelValues(p.addr).Add(1)
-	RcodeCount.WithLabelValues(rc, p.addr).Add(1)
-	RequestDuration.WithLabelValues(p.addr, rc).Observe(time.Since(start).Seconds())
-
 	return ret, nil
 }
 
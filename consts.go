@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
@@ -19,9 +20,16 @@ type ClientSubnet struct {
 type Forward struct {
 	concurrent int64 // atomic counters need to be first in struct for proper alignment
 
+	mu         sync.RWMutex // protects proxies, which change when a host upstream is resolved again
 	proxies    []*Proxy
+	static     []*Proxy        // the upstreams given by address
+	hosts      []*hostUpstream // the upstreams given by host name
+	bootstrap  []string
+	stopHosts  chan struct{}
 	p          Policy
+	hedge      *hedge // set when the slow queries are sent to the next upstream as well
 	hcInterval time.Duration
+	hcProbe    healthProbe
 
 	groupName string
 	ignored   []string
@@ -29,10 +37,23 @@ type Forward struct {
 	eDnsClientSubnet []ClientSubnet
 
 	tlsConfig     *tls.Config
+	tlsEnabled    bool     // set by the tls property
+	tlsArgs       []string // the arguments of the tls property
 	tlsServerName string
+	dohMethod     string
+	pipeline      bool                    // pipeline the TCP and TLS queries
+	minIdle       int                     // TCP or TLS connections kept open per upstream
+	via           string                  // URL of the outbound proxy
+	bind          map[string]*bindOptions // by upstream address, "" for the whole group
+	pins          map[string][][]byte     // by upstream address, "" for the whole group
 	maxfails      uint32
 	expire        time.Duration
 	maxConcurrent int64
+	timeout       time.Duration // of a query, however many upstreams are tried
+	readTimeout   time.Duration // 0 for readTimeout, tunedReadTimeout to tune it per upstream
+	dialTimeout   time.Duration // 0 to tune it per upstream
+	maxAttempts   int           // upstreams a query is sent to at most, 0 until timeout
+	breaker       breakerOptions
 
 	opts options // also here for testing
 
@@ -47,6 +68,11 @@ type Forward struct {
 type Turned struct {
 	Nodes []*Forward
 	Next  plugin.Handler
+
+	explainHTTP *explainServer
+	explainDNS  *explainResponder
+	admin       *adminServer
+	overlay     *ruleOverlay
 }
 
 var (
@@ -66,4 +92,48 @@ type options struct {
 	eDNS               bool
 }
 
+// matchKind is the rule form which matched a name to a group.
+type matchKind int
+
+const (
+	matchNone            matchKind = iota
+	matchFrom                      // zone given by from
+	matchExact                     // exact rule
+	matchWildcard                  // *. rule
+	matchBloom                     // exact rule, probable as the rules are kept in a bloom filter
+	matchBloomWildcard             // *. rule, probable as the rules are kept in a bloom filter
+	matchOverlay                   // exact rule added through the admin API
+	matchOverlayWildcard           // *. rule added through the admin API
+)
+
+func (k matchKind) String() string {
+	switch k {
+	case matchFrom:
+		return "from"
+	case matchExact:
+		return "exact"
+	case matchWildcard:
+		return "wildcard"
+	case matchBloom:
+		return "bloom"
+	case matchBloomWildcard:
+		return "bloom_wildcard"
+	case matchOverlay:
+		return "overlay"
+	case matchOverlayWildcard:
+		return "overlay_wildcard"
+	}
+	return "none"
+}
+
+// matchResult holds how a name matched a group. Rule is the rule that matched, or the except rule which
+// rejected the name when Except is set.
+type matchResult struct {
+	Kind   matchKind
+	Rule   string
+	Except bool
+}
+
+func (m matchResult) matched() bool { return m.Kind != matchNone }
+
 var defaultTimeout = 5 * time.Second
@@ -0,0 +1,427 @@
+package turned
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dialer opens the connections to an upstream, directly or through the outbound proxy set with via.
+type dialer interface {
+	Dial(network, addr string, timeout time.Duration) (net.Conn, error)
+	// UDP reports whether "udp" can be dialed, if not the queries are sent over TCP.
+	UDP() bool
+}
+
+// directDialer dials the upstream itself.
+type directDialer struct{}
+
+func (directDialer) Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout(network, addr, timeout)
+}
+
+func (directDialer) UDP() bool { return true }
+
+// newViaDialer returns the dialer for the proxy URL given to via, socks5:// or http:// with optional
+// user:password. The proxy itself is reached with forward.
+func newViaDialer(via string, forward dialer) (dialer, error) {
+	u, err := url.Parse(via)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("via: missing proxy address: %q", via)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("via: %s", err)
+	}
+
+	switch u.Scheme {
+	case "socks5":
+		return &socks5Dialer{proxy: u.Host, auth: u.User, forward: forward}, nil
+	case "http":
+		return &connectDialer{proxy: u.Host, auth: u.User, forward: forward}, nil
+	}
+	return nil, fmt.Errorf("via: unsupported proxy scheme '%s'", u.Scheme)
+}
+
+// dialDNS opens a dns.Conn for proto ("udp", "tcp" or "tcp-tls") to addr using d. With TLS the
+// handshake is done before returning.
+func dialDNS(d dialer, proto, addr string, tlsConfig *tls.Config, timeout time.Duration) (*dns.Conn, error) {
+	network := "tcp"
+	switch proto {
+	case "udp", transportUnix:
+		network = proto
+	}
+
+	conn, err := d.Dial(network, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if proto != "tcp-tls" {
+		return &dns.Conn{Conn: conn}, nil
+	}
+
+	if tlsConfig.ServerName == "" {
+		// like tls.Dial, default to the host of the address.
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tc := tls.Client(conn, tlsConfig)
+	tc.SetDeadline(time.Now().Add(timeout))
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return &dns.Conn{Conn: tc}, nil
+}
+
+// connectDialer tunnels TCP connections through an HTTP proxy with the CONNECT method.
+type connectDialer struct {
+	proxy   string
+	auth    *url.Userinfo
+	forward dialer
+}
+
+// UDP can't be tunneled through CONNECT.
+func (c *connectDialer) UDP() bool { return false }
+
+func (c *connectDialer) Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("via http://%s: %s is not supported", c.proxy, network)
+	}
+
+	conn, err := c.forward.Dial("tcp", c.proxy, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if c.auth != nil {
+		pass, _ := c.auth.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.auth.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("via http://%s: CONNECT %s: %s", c.proxy, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose first bytes were already read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) { return b.r.Read(p) }
+
+// socks5Dialer connects through a SOCKS5 proxy (RFC 1928), TCP with CONNECT and UDP with UDP ASSOCIATE.
+// The user name and password authentication of RFC 1929 is used when auth is set.
+type socks5Dialer struct {
+	proxy   string
+	auth    *url.Userinfo
+	forward dialer
+}
+
+func (s *socks5Dialer) UDP() bool { return true }
+
+const (
+	socks5Version      = 0x05
+	socks5Connect      = 0x01
+	socks5UDPAssociate = 0x03
+	socks5NoAuth       = 0x00
+	socks5UserPass     = 0x02
+	socks5IPv4         = 0x01
+	socks5Domain       = 0x03
+	socks5IPv6         = 0x04
+)
+
+func (s *socks5Dialer) Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := s.forward.Dial("tcp", s.proxy, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := s.handshake(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("via socks5://%s: %s", s.proxy, err)
+	}
+
+	switch network {
+	case "tcp":
+		if _, err := s.request(conn, socks5Connect, addr); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("via socks5://%s: CONNECT %s: %s", s.proxy, addr, err)
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+
+	case "udp":
+		uc, err := s.associate(conn, addr, timeout)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("via socks5://%s: UDP ASSOCIATE: %s", s.proxy, err)
+		}
+		conn.SetDeadline(time.Time{})
+		return uc, nil
+	}
+
+	conn.Close()
+	return nil, fmt.Errorf("via socks5://%s: %s is not supported", s.proxy, network)
+}
+
+// handshake negotiates the authentication method.
+func (s *socks5Dialer) handshake(conn net.Conn) error {
+	methods := []byte{socks5NoAuth}
+	if s.auth != nil {
+		methods = []byte{socks5UserPass}
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("unexpected version %d", buf[0])
+	}
+
+	switch buf[1] {
+	case socks5NoAuth:
+		return nil
+	case socks5UserPass:
+		if s.auth == nil {
+			return errors.New("proxy requires authentication")
+		}
+		user := s.auth.Username()
+		pass, _ := s.auth.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("user name or password too long")
+		}
+		req := []byte{0x01, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+		return nil
+	}
+	return errors.New("no acceptable authentication method")
+}
+
+// request sends cmd for addr and returns the bound address of the reply.
+func (s *socks5Dialer) request(conn net.Conn, cmd byte, addr string) (*net.UDPAddr, error) {
+	req, err := appendSocks5Addr([]byte{socks5Version, cmd, 0x00}, addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	if buf[1] != 0x00 {
+		return nil, fmt.Errorf("request failed with code %d", buf[1])
+	}
+	return readSocks5Addr(conn)
+}
+
+// associate sets up the UDP relay; the relay lives as long as the control connection.
+func (s *socks5Dialer) associate(conn net.Conn, addr string, timeout time.Duration) (net.Conn, error) {
+	target, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	relay, err := s.request(conn, socks5UDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	if relay.IP.IsUnspecified() {
+		// the relay listens on all the addresses of the proxy.
+		relay.IP = conn.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	uc, err := s.forward.Dial("udp", relay.String(), timeout)
+	if err != nil {
+		return nil, err
+	}
+	header, _ := appendSocks5Addr([]byte{0x00, 0x00, 0x00}, target.String())
+	return &socks5UDPConn{Conn: uc, ctrl: conn, target: target, header: header}, nil
+}
+
+// socks5UDPConn sends datagrams to target through the UDP relay of a SOCKS5 proxy. It implements
+// net.PacketConn so dns.Conn doesn't prefix the messages with their length.
+type socks5UDPConn struct {
+	net.Conn
+	ctrl   net.Conn
+	target *net.UDPAddr
+	header []byte
+}
+
+func (c *socks5UDPConn) Write(p []byte) (int, error) {
+	if _, err := c.Conn.Write(append(append([]byte{}, c.header...), p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *socks5UDPConn) Read(p []byte) (int, error) {
+	buf := make([]byte, len(p)+len(c.header)+16)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		// skip RSV, FRAG and the address, fragmented datagrams are dropped.
+		if n < 4 || buf[2] != 0x00 {
+			continue
+		}
+		off := 4
+		switch buf[3] {
+		case socks5IPv4:
+			off += net.IPv4len + 2
+		case socks5IPv6:
+			off += net.IPv6len + 2
+		case socks5Domain:
+			if n < 5 {
+				continue
+			}
+			off += 1 + int(buf[4]) + 2
+		default:
+			continue
+		}
+		if off > n {
+			continue
+		}
+		return copy(p, buf[off:n]), nil
+	}
+}
+
+func (c *socks5UDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.Read(p)
+	return n, c.target, err
+}
+
+func (c *socks5UDPConn) WriteTo(p []byte, _ net.Addr) (int, error) { return c.Write(p) }
+
+func (c *socks5UDPConn) RemoteAddr() net.Addr { return c.target }
+
+func (c *socks5UDPConn) Close() error {
+	c.ctrl.Close()
+	return c.Conn.Close()
+}
+
+// appendSocks5Addr appends the ATYP, address and port of addr to b.
+func appendSocks5Addr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(append(b, socks5IPv4), ip4...)
+		} else {
+			b = append(append(b, socks5IPv6), ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %q", host)
+		}
+		b = append(append(b, socks5Domain, byte(len(host))), host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// readSocks5Addr reads the ATYP, address and port of a reply.
+func readSocks5Addr(r io.Reader) (*net.UDPAddr, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return nil, err
+	}
+
+	var ip net.IP
+	switch atyp[0] {
+	case socks5IPv4:
+		ip = make(net.IP, net.IPv4len)
+	case socks5IPv6:
+		ip = make(net.IP, net.IPv6len)
+	case socks5Domain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return nil, err
+		}
+		// a bound host name is not expected, read it away and use the address of the proxy.
+		if _, err := io.ReadFull(r, make([]byte, int(l[0]))); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown address type %d", atyp[0])
+	}
+	if ip != nil {
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, err
+		}
+	} else {
+		ip = net.IPv4zero
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port))}, nil
+}
@@ -0,0 +1,243 @@
+package turned
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// newViaUpstream starts a DNS server answering over UDP and TCP, it counts the queries of each.
+func newViaUpstream(t *testing.T, udp, tcp *int32) string {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			atomic.AddInt32(udp, 1)
+		} else {
+			atomic.AddInt32(tcp, 1)
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" 3600 IN A 192.0.2.1"))
+		w.WriteMsg(ret)
+	})
+	t.Cleanup(s.Close)
+	_, port, _ := net.SplitHostPort(s.Addr)
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// newSocks5Server starts a minimal SOCKS5 proxy with user name and password authentication, it supports
+// CONNECT and UDP ASSOCIATE.
+func newSocks5Server(t *testing.T, user, pass string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSocks5(conn, user, pass)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func serveSocks5(conn net.Conn, user, pass string) {
+	defer conn.Close()
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	io.ReadFull(conn, make([]byte, buf[1]))
+	conn.Write([]byte{socks5Version, socks5UserPass})
+
+	// RFC 1929: VER ULEN UNAME PLEN PASSWD
+	io.ReadFull(conn, buf[:2])
+	u := make([]byte, buf[1])
+	io.ReadFull(conn, u)
+	io.ReadFull(conn, buf[:1])
+	p := make([]byte, buf[0])
+	io.ReadFull(conn, p)
+	if string(u) != user || string(p) != pass {
+		conn.Write([]byte{0x01, 0x01})
+		return
+	}
+	conn.Write([]byte{0x01, 0x00})
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	addr, err := readSocks5Addr(conn)
+	if err != nil {
+		return
+	}
+
+	switch req[1] {
+	case socks5Connect:
+		upstream, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			conn.Write([]byte{socks5Version, 0x05, 0x00, socks5IPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		reply, _ := appendSocks5Addr([]byte{socks5Version, 0x00, 0x00}, upstream.LocalAddr().String())
+		conn.Write(reply)
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+
+	case socks5UDPAssociate:
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		reply, _ := appendSocks5Addr([]byte{socks5Version, 0x00, 0x00}, relay.LocalAddr().String())
+		conn.Write(reply)
+
+		go func() {
+			var client *net.UDPAddr
+			b := make([]byte, dns.MaxMsgSize)
+			for {
+				n, from, err := relay.ReadFromUDP(b)
+				if err != nil {
+					return
+				}
+				if from.Port == addr.Port || client != nil && from.String() != client.String() {
+					// a reply of the upstream, wrap it for the client.
+					header, _ := appendSocks5Addr([]byte{0x00, 0x00, 0x00}, from.String())
+					relay.WriteToUDP(append(header, b[:n]...), client)
+					continue
+				}
+				client = from
+				// RSV RSV FRAG ATYP DST.ADDR DST.PORT, only IPv4 in the test.
+				target := &net.UDPAddr{IP: net.IP(b[4:8]), Port: int(binary.BigEndian.Uint16(b[8:10]))}
+				relay.WriteToUDP(b[10:n], target)
+			}
+		}()
+		// the association lives as long as the control connection.
+		io.Copy(io.Discard, conn)
+	}
+}
+
+// newConnectServer starts an HTTP proxy that only supports CONNECT.
+func newConnectServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || r.Method != http.MethodConnect {
+					return
+				}
+				upstream, err := net.Dial("tcp", r.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer upstream.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestVia(t *testing.T) {
+	tests := []struct {
+		name     string
+		via      func(t *testing.T) string
+		udp, tcp int32
+	}{
+		{"socks5", func(t *testing.T) string { return "socks5://user:secret@" + newSocks5Server(t, "user", "secret") }, 2, 0},
+		{"http", func(t *testing.T) string { return "http://" + newConnectServer(t) }, 0, 2},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var udp, tcp int32
+			addr := newViaUpstream(t, &udp, &tcp)
+
+			d, err := newViaDialer(tc.via(t), directDialer{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := NewProxy(addr, "dns")
+			p.SetDialer(d)
+			p.start(hcInterval)
+			defer p.stop()
+
+			m := new(dns.Msg)
+			m.SetQuestion("example.org.", dns.TypeA)
+			state := request.Request{W: &test.ResponseWriter{}, Req: m}
+
+			ret, err := p.Connect(context.Background(), state, options{})
+			if err != nil {
+				t.Fatalf("Expected to receive reply, but didn't: %s", err)
+			}
+			if !state.Match(ret) || len(ret.Answer) != 1 {
+				t.Fatalf("Unexpected reply: %s", ret)
+			}
+			if err := p.health.Check(p); err != nil {
+				t.Errorf("Expected healthy upstream, got %s", err)
+			}
+
+			if n := atomic.LoadInt32(&udp); n != tc.udp {
+				t.Errorf("Expected %d queries over UDP, got %d", tc.udp, n)
+			}
+			if n := atomic.LoadInt32(&tcp); n != tc.tcp {
+				t.Errorf("Expected %d queries over TCP, got %d", tc.tcp, n)
+			}
+		})
+	}
+}
+
+func TestViaAuthFailure(t *testing.T) {
+	var udp, tcp int32
+	addr := newViaUpstream(t, &udp, &tcp)
+
+	d, err := newViaDialer("socks5://user:wrong@"+newSocks5Server(t, "user", "secret"), directDialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProxy(addr, "dns")
+	p.SetDialer(d)
+	if err := p.health.Check(p); err == nil {
+		t.Error("Expected an error with wrong credentials")
+	}
+}
+
+func TestNewViaDialer(t *testing.T) {
+	for _, via := range []string{"socks5://127.0.0.1", "ftp://127.0.0.1:21", "127.0.0.1:1080"} {
+		if _, err := newViaDialer(via, directDialer{}); err == nil {
+			t.Errorf("Expected an error for %q", via)
+		}
+	}
+}
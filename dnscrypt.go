@@ -0,0 +1,137 @@
+package turned
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
+)
+
+const transportDNSCrypt = "sdns"
+
+// dnscryptClient is a DNSCrypt v2 client. The resolver certificate is fetched on the first query and again
+// once it expired, or when a reply can't be decrypted because the resolver rotated its keys. Queries go
+// over UDP and are retried over TCP when the reply is truncated.
+type dnscryptClient struct {
+	stamp dnsstamps.ServerStamp
+	udp   *dnscrypt.Client
+	tcp   *dnscrypt.Client
+
+	mu   sync.Mutex
+	info *dnscrypt.ResolverInfo
+}
+
+// parseDNSCryptStamp parses the sdns:// stamp given to `to`, only DNSCrypt stamps are accepted.
+func parseDNSCryptStamp(s string) (dnsstamps.ServerStamp, error) {
+	stamp, err := dnsstamps.NewServerStampFromString(s)
+	if err != nil {
+		return stamp, err
+	}
+	if stamp.Proto != dnsstamps.StampProtoTypeDNSCrypt {
+		return stamp, fmt.Errorf("not a DNSCrypt stamp: %q", s)
+	}
+	return stamp, nil
+}
+
+func newDNSCryptClient(stamp dnsstamps.ServerStamp) *dnscryptClient {
+	return &dnscryptClient{
+		stamp: stamp,
+		udp:   &dnscrypt.Client{Net: "udp", Timeout: readTimeout, UDPSize: dns.DefaultMsgSize},
+		tcp:   &dnscrypt.Client{Net: "tcp", Timeout: readTimeout},
+	}
+}
+
+// SetTLSConfig is a noop, DNSCrypt doesn't use TLS.
+func (d *dnscryptClient) SetTLSConfig(*tls.Config) {}
+
+// SetExpire is a noop, every query uses a new socket.
+func (d *dnscryptClient) SetExpire(time.Duration) {}
+
+func (d *dnscryptClient) Start() {}
+func (d *dnscryptClient) Stop()  {}
+
+// resolver returns the resolver info, fetching the certificate when there is none yet or it expired.
+func (d *dnscryptClient) resolver(refresh bool) (*dnscrypt.ResolverInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.info != nil && !refresh && d.info.ResolverCert.VerifyDate() {
+		return d.info, nil
+	}
+
+	info, err := d.udp.DialStamp(d.stamp)
+	if err != nil {
+		// some resolvers only answer the certificate query over TCP.
+		if info, err = d.tcp.DialStamp(d.stamp); err != nil {
+			return nil, err
+		}
+	}
+	log.Debugf("DNSCrypt certificate of %s valid until %s", d.stamp.ProviderName,
+		time.Unix(int64(info.ResolverCert.NotAfter), 0))
+	d.info = info
+	return info, nil
+}
+
+// Exchange encrypts m and sends it to the resolver, it gives up when ctx is done.
+func (d *dnscryptClient) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	info, err := d.resolver(false)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := d.exchange(ctx, m, info)
+	if err != nil && isDNSCryptKeyError(err) {
+		// the resolver rotated its certificate, fetch the new one and try again.
+		if info, err = d.resolver(true); err != nil {
+			return nil, err
+		}
+		ret, err = d.exchange(ctx, m, info)
+	}
+	return ret, err
+}
+
+// exchange sends m over UDP, and again over TCP when the reply is truncated. The reply is waited for the read
+// timeout of the proxy, given by ctx.
+func (d *dnscryptClient) exchange(ctx context.Context, m *dns.Msg, info *dnscrypt.ResolverInfo) (*dns.Msg, error) {
+	timeout := readTimeoutOf(ctx)
+	ret, err := exchangeConn(ctx, d.udp, timeout, m, info)
+	if err != nil || !ret.Truncated {
+		return ret, err
+	}
+	return exchangeConn(ctx, d.tcp, timeout, m, info)
+}
+
+// exchangeConn sends m with c over a new connection, which is closed when ctx is done. The read and
+// write timeout is timeout, it doesn't go past the deadline of ctx.
+func exchangeConn(ctx context.Context, c *dnscrypt.Client, timeout time.Duration, m *dns.Msg, info *dnscrypt.ResolverInfo) (*dns.Msg, error) {
+	conn, err := new(net.Dialer).DialContext(ctx, c.Net, info.ServerAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	client := *c
+	client.Timeout = timeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		client.Timeout = time.Until(deadline)
+	}
+	ret, err := client.ExchangeConn(conn, m, info)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return ret, err
+}
+
+// isDNSCryptKeyError reports whether err comes from a reply the current keys can't decrypt.
+func isDNSCryptKeyError(err error) bool {
+	return errors.Is(err, dnscrypt.ErrInvalidResolverMagic) || errors.Is(err, dnscrypt.ErrInvalidResponse)
+}
@@ -0,0 +1,164 @@
+package turned
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+)
+
+type dnscryptHandler struct {
+	tcp *int32
+}
+
+// ServeDNS answers with one A record, or with 100 of them for big.example.org. to get truncated over UDP.
+// It answers slow.example.org. after 500ms.
+func (h dnscryptHandler) ServeDNS(rw dnscrypt.ResponseWriter, r *dns.Msg) error {
+	if _, ok := rw.RemoteAddr().(*net.TCPAddr); ok {
+		atomic.AddInt32(h.tcp, 1)
+	}
+	if r.Question[0].Name == "slow.example.org." {
+		time.Sleep(500 * time.Millisecond)
+	}
+	ret := new(dns.Msg)
+	ret.SetReply(r)
+	n := 1
+	if r.Question[0].Name == "big.example.org." {
+		n = 100
+	}
+	for i := 0; i < n; i++ {
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" 3600 IN A 192.0.2.1"))
+	}
+	return rw.WriteMsg(ret)
+}
+
+// newDNSCryptServer starts a DNSCrypt resolver on UDP and TCP, it returns its sdns:// stamp.
+func newDNSCryptServer(t *testing.T, tcpQueries *int32) string {
+	rc, err := dnscrypt.GenerateResolverConfig("2.dnscrypt-cert.example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := rc.CreateCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnscrypt.Server{ProviderName: rc.ProviderName, ResolverCert: cert, Handler: dnscryptHandler{tcpQueries}}
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: udp.LocalAddr().(*net.UDPAddr).Port})
+	if err != nil {
+		udp.Close()
+		t.Skipf("TCP port of %s not available: %s", udp.LocalAddr(), err)
+	}
+	go s.ServeUDP(udp)
+	go s.ServeTCP(tcp)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+	stamp, err := rc.CreateStamp(udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stamp.String()
+}
+
+func TestDNSCryptProxy(t *testing.T) {
+	var tcpQueries int32
+	f := New()
+	if err := parseTo(f, []string{newDNSCryptServer(t, &tcpQueries)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.setupProxies(); err != nil {
+		t.Fatal(err)
+	}
+	p := f.proxies[0]
+
+	query := func(name string, answers int) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		state := request.Request{W: &test.ResponseWriter{}, Req: m}
+
+		ret, err := p.Connect(context.Background(), state, options{})
+		if err != nil {
+			t.Fatalf("Expected to receive reply, but didn't: %s", err)
+		}
+		if !state.Match(ret) || len(ret.Answer) != answers || ret.Truncated {
+			t.Fatalf("Unexpected reply: %s", ret)
+		}
+	}
+
+	query("example.org.", 1)
+	// truncated over UDP, retried over TCP.
+	query("big.example.org.", 100)
+	if n := atomic.LoadInt32(&tcpQueries); n != 1 {
+		t.Errorf("Expected 1 query over TCP, got %d", n)
+	}
+
+	// an expired certificate is fetched again.
+	c := p.exchanger.(*dnscryptClient)
+	info := c.info
+	info.ResolverCert.NotAfter = 1
+	query("example.org.", 1)
+	if c.info == info {
+		t.Errorf("Expected the expired certificate to be fetched again")
+	}
+
+	if err := p.health.Check(p); err != nil {
+		t.Errorf("Expected healthy upstream, got %s", err)
+	}
+
+	// a timeout isn't retried over TCP.
+	m := new(dns.Msg)
+	m.SetQuestion("slow.example.org.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.Exchange(ctx, m); err == nil {
+		t.Error("Expected the query to time out")
+	}
+	if d := time.Since(start); d > 300*time.Millisecond {
+		t.Errorf("Expected the query to stop after 100ms, took %s", d)
+	}
+	if n := atomic.LoadInt32(&tcpQueries); n != 1 {
+		t.Errorf("Expected no query over TCP after the timeout, got %d", n-1)
+	}
+}
+
+func TestDNSCryptReadTimeout(t *testing.T) {
+	var tcpQueries int32
+	app, err := parseTurned(caddy.NewTestController("dns", "turned dnscrypt {\nto "+newDNSCryptServer(t, &tcpQueries)+"\nread_timeout 100ms\n}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := app.Nodes[0].proxies[0]
+
+	m := new(dns.Msg)
+	m.SetQuestion("slow.example.org.", dns.TypeA)
+	start := time.Now()
+	if _, err := p.Connect(context.Background(), request.Request{W: &test.ResponseWriter{}, Req: m}, options{}); err == nil {
+		t.Error("Expected the query to time out")
+	}
+	if d := time.Since(start); d > 400*time.Millisecond {
+		t.Errorf("Expected the query to stop after the read timeout of 100ms, took %s", d)
+	}
+}
+
+func TestParseDNSCryptStamp(t *testing.T) {
+	// DoH stamp of dns.google
+	if _, err := parseDNSCryptStamp("sdns://AgUAAAAAAAAAAAAKZG5zLmdvb2dsZQovZG5zLXF1ZXJ5"); err == nil {
+		t.Errorf("Expected an error for a DoH stamp")
+	}
+	if _, err := parseDNSCryptStamp("sdns://invalid"); err == nil {
+		t.Errorf("Expected an error for an invalid stamp")
+	}
+}
@@ -0,0 +1,129 @@
+package turned
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/doh"
+
+	"github.com/miekg/dns"
+)
+
+// dohClient is a DNS-over-HTTPS (RFC 8484) client, the connections are kept by the http.Transport and
+// reused over HTTP/2.
+type dohClient struct {
+	url    string
+	method string
+
+	tr     *http.Transport
+	client *http.Client
+}
+
+func newDoHClient(u string) *dohClient {
+	tr := &http.Transport{
+		ForceAttemptHTTP2:   true,
+		TLSClientConfig:     new(tls.Config),
+		TLSHandshakeTimeout: maxDialTimeout,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     defaultExpire,
+	}
+	return &dohClient{
+		url:    u,
+		method: http.MethodPost,
+		tr:     tr,
+		client: &http.Client{Transport: tr},
+	}
+}
+
+// parseDoHURL checks the https:// URL given to `to`, the path defaults to /dns-query.
+func parseDoHURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("not a DNS-over-HTTPS URL: %q", s)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = doh.Path
+	}
+	return u.String(), nil
+}
+
+// SetTLSConfig sets the TLS config used for the HTTPS connections.
+func (d *dohClient) SetTLSConfig(cfg *tls.Config) { d.tr.TLSClientConfig = cfg.Clone() }
+
+// pin makes the connections of d go to addr, whatever the host of the URL resolves to.
+func (d *dohClient) pin(addr string) {
+	dialer := &net.Dialer{Timeout: maxDialTimeout}
+	d.tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// SetExpire sets the time an idle connection is kept.
+func (d *dohClient) SetExpire(expire time.Duration) { d.tr.IdleConnTimeout = expire }
+
+func (d *dohClient) Start() {}
+
+// Stop closes the idle connections.
+func (d *dohClient) Stop() { d.tr.CloseIdleConnections() }
+
+// Exchange sends m with d.method and returns the reply.
+func (d *dohClient) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	// RFC 8484 4.1: the ID should be 0 to be cache friendly, it is restored in the reply.
+	buf[0], buf[1] = 0, 0
+
+	var req *http.Request
+	if d.method == http.MethodGet {
+		sep := "?"
+		if strings.Contains(d.url, "?") {
+			sep = "&"
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, d.url+sep+"dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(buf))
+		if err == nil {
+			req.Header.Set("Content-Type", doh.MimeType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", doh.MimeType)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("%s: unexpected HTTP status %s", d.url, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	ret := new(dns.Msg)
+	if err := ret.Unpack(body); err != nil {
+		return nil, err
+	}
+	ret.Id = m.Id
+	return ret, nil
+}
@@ -0,0 +1,168 @@
+package turned
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/doh"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func newDoHServer(t *testing.T, h2 *int32) *httptest.Server {
+	return newDelayedDoHServer(t, "192.0.2.1", 0, h2)
+}
+
+// newDelayedDoHServer starts a DoH server answering ip after delay, counting the HTTP/2 requests in h2.
+func newDelayedDoHServer(t *testing.T, ip string, delay time.Duration, h2 *int32) *httptest.Server {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != doh.Path {
+			http.NotFound(w, r)
+			return
+		}
+		if r.ProtoMajor == 2 {
+			atomic.AddInt32(h2, 1)
+		}
+		m, err := doh.RequestToMsg(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(m)
+		ret.Answer = append(ret.Answer, test.A(m.Question[0].Name+" 3600 IN A "+ip))
+		buf, _ := ret.Pack()
+		w.Header().Set("Content-Type", doh.MimeType)
+		w.Write(buf)
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestDoHProxy(t *testing.T) {
+	var h2 int32
+	s := newDoHServer(t, &h2)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			u, err := parseDoHURL(s.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := NewProxy(u, "https")
+			p.SetTLSConfig(&tls.Config{RootCAs: pool})
+			p.exchanger.(*dohClient).method = method
+			p.start(hcInterval)
+			defer p.stop()
+
+			for i := 0; i < 2; i++ {
+				m := new(dns.Msg)
+				m.SetQuestion("example.org.", dns.TypeA)
+				state := request.Request{W: &test.ResponseWriter{}, Req: m}
+
+				ret, err := p.Connect(context.Background(), state, options{})
+				if err != nil {
+					t.Fatalf("Expected to receive reply, but didn't: %s", err)
+				}
+				if !state.Match(ret) || len(ret.Answer) != 1 {
+					t.Fatalf("Unexpected reply: %s", ret)
+				}
+			}
+
+			if err := p.health.Check(p); err != nil {
+				t.Errorf("Expected healthy upstream, got %s", err)
+			}
+		})
+	}
+
+	if n := atomic.LoadInt32(&h2); n != 6 {
+		t.Errorf("Expected 6 HTTP/2 requests, got %d", n)
+	}
+}
+
+func TestDoHCanceled(t *testing.T) {
+	var h2 int32
+	s := newDelayedDoHServer(t, "192.0.2.1", 500*time.Millisecond, &h2)
+
+	u, err := parseDoHURL(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProxy(u, "https")
+	p.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	p.SetCircuitBreaker(1, time.Minute, time.Minute)
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := p.Connect(ctx, request.Request{W: &test.ResponseWriter{}, Req: m}, options{}); err == nil {
+		t.Fatal("Expected the canceled query to fail")
+	}
+
+	// the query given up on says nothing about the upstream.
+	if st := p.Stats(); st.ErrorRate != 0 || st.Circuit != "up" {
+		t.Errorf("Expected no failure observed, got an error rate of %f and circuit %s", st.ErrorRate, st.Circuit)
+	}
+}
+
+// dohCA writes the certificate of the test DoH servers to a file, for tls.
+func dohCA(t *testing.T, s *httptest.Server) string {
+	name := filepath.Join(t.TempDir(), "ca.pem")
+	buf := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	if err := os.WriteFile(name, buf, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestDoHForward(t *testing.T) {
+	var h2 int32
+	s := newDoHServer(t, &h2)
+
+	f := New()
+	f.tlsConfig.InsecureSkipVerify = true
+	if err := parseTo(f, []string{s.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.setupProxies(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range f.proxies {
+		p.start(hcInterval)
+		defer p.stop()
+	}
+
+	app := &Turned{Nodes: []*Forward{f}}
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := app.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Msg == nil || rec.Msg.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("Unexpected reply: %v", rec.Msg)
+	}
+}
@@ -0,0 +1,220 @@
+package turned
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	transportQUIC = "quic"
+	quicPort      = "853"
+)
+
+// doqALPN is the ALPN token of DNS-over-QUIC, RFC 9250 4.1.1.
+var doqALPN = []string{"doq"}
+
+// doqNoError is the DOQ_NO_ERROR code used to close the connection, RFC 9250 4.3.
+const doqNoError = 0x0
+
+// doqClient is a DNS-over-QUIC (RFC 9250) client. Every query is sent on its own stream of a long-lived
+// connection, which is dialed again once the idle timeout closed it.
+type doqClient struct {
+	addr      string
+	tlsConfig *tls.Config
+	expire    time.Duration
+
+	mu   sync.Mutex
+	conn quic.Connection
+}
+
+func newDoQClient(addr string) *doqClient {
+	return &doqClient{addr: addr, tlsConfig: &tls.Config{NextProtos: doqALPN}, expire: defaultExpire}
+}
+
+// parseQUICAddr returns the host:port of a quic:// upstream, the port defaults to 853.
+func parseQUICAddr(s string) (string, error) {
+	host := strings.TrimPrefix(s, transportQUIC+"://")
+	addr, _, err := net.SplitHostPort(host)
+	if err != nil {
+		addr = host
+		host = net.JoinHostPort(host, quicPort)
+	}
+	if net.ParseIP(addr) == nil {
+		return "", fmt.Errorf("not an IP address: %q", s)
+	}
+	return host, nil
+}
+
+// SetTLSConfig sets the TLS config of the QUIC connections, the ALPN is always doq.
+func (d *doqClient) SetTLSConfig(cfg *tls.Config) {
+	cfg = cfg.Clone()
+	cfg.NextProtos = doqALPN
+	d.tlsConfig = cfg
+}
+
+// SetExpire sets the idle timeout of the QUIC connection.
+func (d *doqClient) SetExpire(expire time.Duration) { d.expire = expire }
+
+func (d *doqClient) Start() {}
+
+// Stop closes the QUIC connection.
+func (d *doqClient) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil {
+		d.conn.CloseWithError(doqNoError, "")
+		d.conn = nil
+	}
+}
+
+// dial returns the current connection, or dials a new one if there is none or it is closed. The connection
+// is returned as soon as 0-RTT data can be sent, when the TLS session is resumed.
+func (d *doqClient) dial(ctx context.Context) (quic.Connection, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn != nil && d.conn.Context().Err() == nil {
+		return d.conn, nil
+	}
+
+	tlsConfig := d.tlsConfig
+	if tlsConfig.ServerName == "" {
+		// unlike crypto/tls, quic-go doesn't default to the host of the address.
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(d.addr)
+	}
+
+	conn, err := quic.DialAddrEarly(ctx, d.addr, tlsConfig, &quic.Config{
+		HandshakeIdleTimeout: maxDialTimeout,
+		MaxIdleTimeout:       d.expire,
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.conn = conn
+	return conn, nil
+}
+
+// drop forgets conn, so the next query dials a new connection.
+func (d *doqClient) drop(conn quic.Connection) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn == conn {
+		d.conn = nil
+	}
+}
+
+// Exchange sends m on a new stream and returns the reply.
+func (d *doqClient) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	// RFC 9250 4.2.1: the ID must be 0, it is restored in the reply.
+	buf[0], buf[1] = 0, 0
+	msg := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(msg, uint16(len(buf)))
+	copy(msg[2:], buf)
+
+	ret, err := d.exchange(ctx, msg)
+	var idle *quic.IdleTimeoutError
+	if errors.As(err, &idle) || errors.Is(err, quic.ErrServerClosed) || isApplicationClose(err) {
+		// The cached connection was closed meanwhile, try once more on a new one.
+		ret, err = d.exchange(ctx, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret.Id = m.Id
+	return ret, nil
+}
+
+func isApplicationClose(err error) bool {
+	var appErr *quic.ApplicationError
+	return errors.As(err, &appErr)
+}
+
+func (d *doqClient) exchange(ctx context.Context, msg []byte) (*dns.Msg, error) {
+	conn, err := d.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		d.drop(conn)
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	if _, err := stream.Write(msg); err != nil {
+		stream.CancelWrite(doqNoError)
+		stream.CancelRead(doqNoError)
+		d.drop(conn)
+		return nil, err
+	}
+	// RFC 9250 4.2: the client closes the sending side after the query.
+	stream.Close()
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		stream.CancelRead(doqNoError)
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		stream.CancelRead(doqNoError)
+		return nil, err
+	}
+
+	ret := new(dns.Msg)
+	if err := ret.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// doqHc is a health checker for DNS-over-QUIC upstreams. It keeps its own connection, so the probes
+// don't queue behind the query streams.
+type doqHc struct {
+	c                *doqClient
+	recursionDesired bool
+	probe            healthProbe
+}
+
+func (h *doqHc) SetTLSConfig(cfg *tls.Config) { h.c.SetTLSConfig(cfg) }
+
+func (h *doqHc) SetRecursionDesired(recursionDesired bool) {
+	h.recursionDesired = recursionDesired
+}
+func (h *doqHc) GetRecursionDesired() bool {
+	return h.recursionDesired
+}
+
+func (h *doqHc) SetProbe(probe healthProbe) { h.probe = probe }
+
+// Check is used as the up.Func in the up.Probe.
+func (h *doqHc) Check(p *Proxy) error {
+	if h.c.addr == "" {
+		h.c.addr = p.addr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hcReadTimeout+hcWriteTimeout)
+	defer cancel()
+
+	m, err := h.c.Exchange(ctx, h.probe.query(h.recursionDesired))
+	return checked(p, h.probe.check(m, err))
+}
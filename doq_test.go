@@ -0,0 +1,190 @@
+package turned
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// newTestCert returns a self-signed certificate for 127.0.0.1 and the pool trusting it.
+func newTestCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "turned test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:     []string{"dns.example"},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+// newDoQServer starts a DNS-over-QUIC server answering every query with 192.0.2.1. It counts the
+// connections and the ones resuming a TLS session.
+func newDoQServer(t *testing.T, cert tls.Certificate, conns, resumed *int32) string {
+	ln, err := quic.ListenAddrEarly("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: doqALPN},
+		&quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(conns, 1)
+			go func() {
+				<-conn.HandshakeComplete()
+				if conn.ConnectionState().TLS.DidResume {
+					atomic.AddInt32(resumed, 1)
+				}
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go serveDoQStream(stream)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveDoQStream(stream quic.Stream) {
+	defer stream.Close()
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		return
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil || m.Id != 0 {
+		return
+	}
+
+	ret := new(dns.Msg)
+	ret.SetReply(m)
+	ret.Answer = append(ret.Answer, test.A(m.Question[0].Name+" 3600 IN A 192.0.2.1"))
+	out, _ := ret.Pack()
+	binary.Write(stream, binary.BigEndian, uint16(len(out)))
+	stream.Write(out)
+}
+
+func TestDoQProxy(t *testing.T) {
+	cert, pool := newTestCert(t)
+	var conns, resumed int32
+	addr := newDoQServer(t, cert, &conns, &resumed)
+
+	f := New()
+	f.tlsConfig.RootCAs = pool
+	if err := parseTo(f, []string{"quic://" + addr}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.setupProxies(); err != nil {
+		t.Fatal(err)
+	}
+	p := f.proxies[0]
+	p.start(time.Hour)
+	defer p.stop()
+
+	query := func() {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		state := request.Request{W: &test.ResponseWriter{}, Req: m}
+
+		ret, err := p.Connect(context.Background(), state, options{})
+		if err != nil {
+			t.Fatalf("Expected to receive reply, but didn't: %s", err)
+		}
+		if !state.Match(ret) || len(ret.Answer) != 1 {
+			t.Fatalf("Unexpected reply: %s", ret)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		query()
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("Expected the queries to share 1 connection, got %d", n)
+	}
+
+	// the next connection resumes the TLS session.
+	p.exchanger.Stop()
+	query()
+	if n := atomic.LoadInt32(&resumed); n != 1 {
+		t.Errorf("Expected 1 resumed connection, got %d", n)
+	}
+
+	if err := p.health.Check(p); err != nil {
+		t.Errorf("Expected healthy upstream, got %s", err)
+	}
+	if _, ok := p.health.(*doqHc); !ok {
+		t.Errorf("Expected a DoQ health checker, got %T", p.health)
+	}
+}
+
+func TestParseQUICAddr(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{in: "quic://192.0.2.1", want: "192.0.2.1:853"},
+		{in: "quic://192.0.2.1:8853", want: "192.0.2.1:8853"},
+		{in: "quic://[2001:db8::1]:853", want: "[2001:db8::1]:853"},
+		{in: "quic://dns.example", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseQUICAddr(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("parseQUICAddr(%q) error = %v", tt.in, err)
+		}
+		if got != tt.want {
+			t.Errorf("parseQUICAddr(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
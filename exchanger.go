@@ -0,0 +1,51 @@
+package turned
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/transport"
+
+	"github.com/miekg/dns"
+)
+
+// exchanger sends queries to an upstream that is not reached through the cached connections of
+// Transport, it manages its own connections.
+type exchanger interface {
+	Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	SetTLSConfig(*tls.Config)
+	SetExpire(time.Duration)
+	Start()
+	Stop()
+}
+
+// newExchanger returns the exchanger for trans, or nil when the upstream uses Transport.
+func newExchanger(addr, trans string) exchanger {
+	switch trans {
+	case transport.HTTPS:
+		return newDoHClient(addr)
+	case transportQUIC:
+		return newDoQClient(addr)
+	case transport.GRPC:
+		return newGRPCClient(addr)
+	}
+	return nil
+}
+
+// readTimeoutKey is the context key of the read timeout of the proxy a query is sent for, the proxies of
+// the groups sharing an exchanger wait for their replies each as long as their group says.
+type readTimeoutKey struct{}
+
+// withReadTimeout returns ctx carrying the read timeout d.
+func withReadTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, readTimeoutKey{}, d)
+}
+
+// readTimeoutOf returns the read timeout carried by ctx, the default one when there is none.
+func readTimeoutOf(ctx context.Context) time.Duration {
+	if d, ok := ctx.Value(readTimeoutKey{}).(time.Duration); ok {
+		return d
+	}
+	return readTimeout
+}
@@ -0,0 +1,179 @@
+package turned
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// explainGroup is the verdict of a single group for an explained name.
+type explainGroup struct {
+	Name     string `json:"name"`
+	Matched  bool   `json:"matched"`
+	Method   string `json:"method,omitempty"`
+	Rule     string `json:"rule,omitempty"`
+	Except   string `json:"except,omitempty"`
+	Selected bool   `json:"selected"`
+}
+
+// explanation tells why a name is sent to a group, the groups are listed in the order they are tried.
+type explanation struct {
+	Name   string         `json:"qname"`
+	Group  string         `json:"group,omitempty"`
+	Groups []explainGroup `json:"groups"`
+}
+
+// explain walks all nodes like ServeDNS does and records the verdict of each of them for name.
+func (app *Turned) explain(name string) *explanation {
+	e := &explanation{Name: PureDomain(name)}
+
+	var (
+		overlay  *Forward
+		overlaid matchResult
+	)
+	if app.overlay != nil {
+		overlay, overlaid = app.overlay.lookup(e.Name)
+	}
+
+	selected := false
+	for _, node := range app.Nodes {
+		m := node.lookup(e.Name)
+		if node == overlay {
+			m = overlaid
+		}
+		g := explainGroup{Name: node.Name(), Matched: m.matched()}
+		if m.Except {
+			g.Except = m.Rule
+		} else if g.Matched {
+			g.Method = m.Kind.String()
+			g.Rule = m.Rule
+		}
+		if g.Matched && !selected && (overlay == nil || node == overlay) {
+			g.Selected = true
+			e.Group = g.Name
+			selected = true
+		}
+		e.Groups = append(e.Groups, g)
+	}
+	return e
+}
+
+// explainServer serves the explanations over HTTP.
+type explainServer struct {
+	*httpServer
+	app *Turned
+}
+
+func newExplainServer(addr string, app *Turned) *explainServer {
+	e := &explainServer{httpServer: newHTTPServer(addr), app: app}
+	e.mux.HandleFunc("/explain", e.serveHTTP)
+	return e
+}
+
+// serveHTTP answers GET /explain?name=example.com, the groups match by name only.
+func (e *explainServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	name := strings.TrimSpace(q.Get("name"))
+	if name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		http.Error(w, "invalid name: "+name, http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, e.app.explain(name))
+}
+
+// explainZone is answered in band when explain_dns is set, a TXT query for <name>.explain.turned. tells
+// how <name> would be forwarded.
+const explainZone = "explain.turned"
+
+// explainResponder answers the explain queries of the allowed clients.
+type explainResponder struct {
+	allowed []*net.IPNet
+}
+
+func newExplainResponder(nets []string) (*explainResponder, error) {
+	e := &explainResponder{}
+	for _, n := range nets {
+		_, ipNet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, fmt.Errorf("explain_dns: %s", err)
+		}
+		e.allowed = append(e.allowed, ipNet)
+	}
+	return e, nil
+}
+
+// wants reports whether q is an explain query sent by an allowed client.
+func (e *explainResponder) wants(w dns.ResponseWriter, q dns.Question) bool {
+	if q.Qtype != dns.TypeTXT || !strings.HasSuffix(PureDomain(q.Name), "."+explainZone) {
+		return false
+	}
+
+	state := request.Request{W: w}
+	ip := net.ParseIP(state.IP())
+	for _, n := range e.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reply writes the TXT records describing how f was selected for name instead of forwarding r.
+func (e *explainResponder) reply(w dns.ResponseWriter, r *dns.Msg, name string, f *Forward, m matchResult, matchedTime time.Duration) (int, error) {
+	var txt []string
+	if f == nil {
+		txt = append(txt, "group=")
+	} else {
+		txt = append(txt, "group="+f.Name())
+		if p := f.pick(w, name); p != nil {
+			txt = append(txt, "upstream="+p.addr)
+		}
+		txt = append(txt, "method="+m.Kind.String(), "rule="+m.Rule)
+	}
+	txt = append(txt, "time="+matchedTime.String())
+
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+	for _, t := range txt {
+		msg.Answer = append(msg.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{t},
+		})
+	}
+	w.WriteMsg(msg)
+	return dns.RcodeSuccess, nil
+}
+
+// pick returns the proxy ServeDNS would try first for an A query of name from the client of w, the explain
+// queries don't change the order of the upstreams.
+func (f *Forward) pick(w dns.ResponseWriter, name string) *Proxy {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	list := f.peek(request.Request{W: w, Req: m})
+	for _, p := range list {
+		if !p.Down(f.maxfails) {
+			return p
+		}
+	}
+	if len(list) > 0 {
+		return list[0]
+	}
+	return nil
+}
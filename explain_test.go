@@ -0,0 +1,161 @@
+package turned
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestExplain(t *testing.T) {
+	hash := New()
+	hash.groupName = "rules"
+	hash.from = ""
+	hash.bottle = NewAdapter()
+	hash.bottle.mapAddString("a.example.com")
+	hash.bottle.mapAddString("*.example.org")
+	hash.bottle.setupContainsFunc()
+
+	final := New()
+	final.ignored = []string{"b.example.com."}
+
+	app := &Turned{Nodes: []*Forward{hash, final}}
+
+	tests := []struct {
+		name   string
+		group  string
+		method string
+		except string
+	}{
+		{name: "a.example.com.", group: "rules", method: "exact"},
+		{name: "www.example.org", group: "rules", method: "wildcard"},
+		{name: "c.example.com", group: "final", method: "from"},
+		{name: "b.example.com", group: "", except: "b.example.com."},
+	}
+	for _, tt := range tests {
+		e := app.explain(tt.name)
+		if e.Group != tt.group {
+			t.Errorf("explain(%q) group = %q, want %q", tt.name, e.Group, tt.group)
+		}
+		if len(e.Groups) != 2 {
+			t.Fatalf("explain(%q) has %d groups, want 2", tt.name, len(e.Groups))
+		}
+		for _, g := range e.Groups {
+			if g.Selected {
+				if g.Method != tt.method {
+					t.Errorf("explain(%q) method = %q, want %q", tt.name, g.Method, tt.method)
+				}
+			}
+		}
+		if got := e.Groups[1].Except; got != tt.except {
+			t.Errorf("explain(%q) except = %q, want %q", tt.name, got, tt.except)
+		}
+	}
+}
+
+func TestExplainDNS(t *testing.T) {
+	f := New()
+	f.groupName = "push"
+	f.proxies = []*Proxy{NewProxy("192.0.2.53:53", "dns")}
+
+	e, err := newExplainResponder([]string{"10.240.0.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &Turned{Nodes: []*Forward{f}, explainDNS: e}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.explain.turned.", dns.TypeTXT)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := app.ServeDNS(context.TODO(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{"group=push": true, "upstream=192.0.2.53:53": true, "method=from": true, "rule=.": true}
+	for _, rr := range rec.Msg.Answer {
+		txt := rr.(*dns.TXT).Txt[0]
+		if strings.HasPrefix(txt, "time=") {
+			continue
+		}
+		if !want[txt] {
+			t.Errorf("unexpected TXT %q", txt)
+		}
+		delete(want, txt)
+	}
+	if len(want) > 0 {
+		t.Errorf("missing TXT %v", want)
+	}
+}
+
+func TestExplainDNSOrder(t *testing.T) {
+	e, err := newExplainResponder([]string{"10.240.0.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, policy := range []Policy{&roundRobin{}, &weighted{}} {
+		f := New()
+		f.p = policy
+		f.proxies = []*Proxy{NewProxy("192.0.2.53:53", "dns"), NewProxy("192.0.2.54:53", "dns")}
+		app := &Turned{Nodes: []*Forward{f}, explainDNS: e}
+
+		var upstreams []string
+		for i := 0; i < 3; i++ {
+			req := new(dns.Msg)
+			req.SetQuestion("www.example.com.explain.turned.", dns.TypeTXT)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := app.ServeDNS(context.TODO(), rec, req); err != nil {
+				t.Fatal(err)
+			}
+			for _, rr := range rec.Msg.Answer {
+				if txt := rr.(*dns.TXT).Txt[0]; strings.HasPrefix(txt, "upstream=") {
+					upstreams = append(upstreams, strings.TrimPrefix(txt, "upstream="))
+				}
+			}
+		}
+		next := f.List()[0].addr
+		for _, u := range upstreams {
+			if u != next {
+				t.Errorf("%s: expected the explain queries to report %s, got %v", policy, next, upstreams)
+				break
+			}
+		}
+	}
+}
+
+func TestExplainDNSQueryPolicy(t *testing.T) {
+	e, err := newExplainResponder([]string{"10.240.0.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := New()
+	f.p = &hash{}
+	f.proxies = newTestProxies(1, 1, 1, 1)
+	app := &Turned{Nodes: []*Forward{f}, explainDNS: e}
+
+	for i := 0; i < 20; i++ {
+		name := "www" + strconv.Itoa(i) + ".example.com."
+		req := new(dns.Msg)
+		req.SetQuestion(name+"explain.turned.", dns.TypeTXT)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := app.ServeDNS(context.TODO(), rec, req); err != nil {
+			t.Fatal(err)
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		want := "upstream=" + f.list(request.Request{W: &test.ResponseWriter{}, Req: m})[0].addr
+		found := false
+		for _, rr := range rec.Msg.Answer {
+			found = found || rr.(*dns.TXT).Txt[0] == want
+		}
+		if !found {
+			t.Errorf("%s: expected %s in the explanation, got %v", name, want, rec.Msg.Answer)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package turned
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/pb"
+
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// grpcPoolSize is the number of client connections kept per gRPC upstream, the queries are spread
+// over them round robin.
+const grpcPoolSize = 4
+
+// grpcClient sends the queries to a CoreDNS gRPC server (DnsService of the pb package). It uses TLS only
+// when the group has the tls property.
+type grpcClient struct {
+	addr  string
+	creds credentials.TransportCredentials
+
+	mu    sync.Mutex
+	conns []*grpc.ClientConn
+	next  uint32
+}
+
+func newGRPCClient(addr string) *grpcClient {
+	return &grpcClient{addr: addr, creds: insecure.NewCredentials()}
+}
+
+// SetTLSConfig makes the client connections use TLS.
+func (g *grpcClient) SetTLSConfig(cfg *tls.Config) { g.creds = credentials.NewTLS(cfg) }
+
+// SetExpire is a noop, the gRPC connections are kept alive by gRPC.
+func (g *grpcClient) SetExpire(time.Duration) {}
+
+func (g *grpcClient) Start() {}
+
+// Stop closes the client connections.
+func (g *grpcClient) Stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, conn := range g.conns {
+		conn.Close()
+	}
+	g.conns = nil
+}
+
+// conn returns the next client connection of the pool, the pool is filled on first use. grpc.Dial doesn't
+// block, the connections are established in the background.
+func (g *grpcClient) conn() (*grpc.ClientConn, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.conns == nil {
+		for i := 0; i < grpcPoolSize; i++ {
+			conn, err := grpc.Dial(g.addr, grpc.WithTransportCredentials(g.creds))
+			if err != nil {
+				for _, c := range g.conns {
+					c.Close()
+				}
+				g.conns = nil
+				return nil, err
+			}
+			g.conns = append(g.conns, conn)
+		}
+	}
+
+	i := atomic.AddUint32(&g.next, 1) % uint32(len(g.conns))
+	return g.conns[i], nil
+}
+
+// Exchange sends m in a DnsPacket and unpacks the reply.
+func (g *grpcClient) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := g.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := pb.NewDnsServiceClient(conn).Query(ctx, &pb.DnsPacket{Msg: buf})
+	if err != nil {
+		return nil, err
+	}
+	ret := new(dns.Msg)
+	if err := ret.Unpack(reply.Msg); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
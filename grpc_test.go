@@ -0,0 +1,98 @@
+package turned
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/pb"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+type grpcDNSServer struct {
+	pb.UnimplementedDnsServiceServer
+}
+
+func (grpcDNSServer) Query(_ context.Context, in *pb.DnsPacket) (*pb.DnsPacket, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(in.Msg); err != nil {
+		return nil, err
+	}
+	ret := new(dns.Msg)
+	ret.SetReply(m)
+	ret.Answer = append(ret.Answer, test.A(m.Question[0].Name+" 3600 IN A 192.0.2.1"))
+	buf, err := ret.Pack()
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DnsPacket{Msg: buf}, nil
+}
+
+func newGRPCServer(t *testing.T, opts ...grpc.ServerOption) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(opts...)
+	pb.RegisterDnsServiceServer(s, grpcDNSServer{})
+	go s.Serve(ln)
+	t.Cleanup(s.Stop)
+	return ln.Addr().String()
+}
+
+func TestGRPCProxy(t *testing.T) {
+	cert, pool := newTestCert(t)
+
+	tests := []struct {
+		name string
+		addr string
+		tls  bool
+	}{
+		{name: "plain", addr: newGRPCServer(t)},
+		{name: "tls", addr: newGRPCServer(t, grpc.Creds(credentials.NewServerTLSFromCert(&cert))), tls: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := New()
+			if tt.tls {
+				f.tlsConfig = &tls.Config{RootCAs: pool}
+				f.tlsEnabled = true
+			}
+			if err := parseTo(f, []string{"grpc://" + tt.addr}); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.setupProxies(); err != nil {
+				t.Fatal(err)
+			}
+			p := f.proxies[0]
+			defer p.exchanger.Stop()
+
+			for i := 0; i < grpcPoolSize+1; i++ {
+				m := new(dns.Msg)
+				m.SetQuestion("example.org.", dns.TypeA)
+				state := request.Request{W: &test.ResponseWriter{}, Req: m}
+
+				ret, err := p.Connect(context.Background(), state, options{})
+				if err != nil {
+					t.Fatalf("Expected to receive reply, but didn't: %s", err)
+				}
+				if !state.Match(ret) || len(ret.Answer) != 1 {
+					t.Fatalf("Unexpected reply: %s", ret)
+				}
+			}
+			if n := len(p.exchanger.(*grpcClient).conns); n != grpcPoolSize {
+				t.Errorf("Expected %d pooled connections, got %d", grpcPoolSize, n)
+			}
+
+			if err := p.health.Check(p); err != nil {
+				t.Errorf("Expected healthy upstream, got %s", err)
+			}
+		})
+	}
+}
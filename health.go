@@ -1,6 +1,7 @@
 package turned
 
 import (
+	"context"
 	"crypto/tls"
 	"sync/atomic"
 	"time"
@@ -16,12 +17,15 @@ type HealthChecker interface {
 	SetTLSConfig(*tls.Config)
 	SetRecursionDesired(bool)
 	GetRecursionDesired() bool
+	SetProbe(healthProbe)
 }
 
 // dnsHc is a health checker for a DNS endpoint (DNS, and DoT).
 type dnsHc struct {
 	c                *dns.Client
+	dialer           dialer
 	recursionDesired bool
+	probe            healthProbe
 }
 
 var (
@@ -38,7 +42,18 @@ func NewHealthChecker(trans string, recursionDesired bool) HealthChecker {
 		c.ReadTimeout = hcReadTimeout
 		c.WriteTimeout = hcWriteTimeout
 
-		return &dnsHc{c: c, recursionDesired: recursionDesired}
+		return &dnsHc{c: c, dialer: directDialer{}, recursionDesired: recursionDesired, probe: defaultHealthProbe}
+	case transportUnix:
+		c := new(dns.Client)
+		c.Net = transportUnix
+		c.ReadTimeout = hcReadTimeout
+		c.WriteTimeout = hcWriteTimeout
+
+		return &dnsHc{c: c, dialer: directDialer{}, recursionDesired: recursionDesired, probe: defaultHealthProbe}
+	case transport.HTTPS, transport.GRPC, transportDNSCrypt:
+		return &exchangeHc{recursionDesired: recursionDesired, probe: defaultHealthProbe}
+	case transportQUIC:
+		return &doqHc{c: newDoQClient(""), recursionDesired: recursionDesired, probe: defaultHealthProbe}
 	}
 
 	log.Warningf("No healthchecker for transport %q", trans)
@@ -57,12 +72,19 @@ func (h *dnsHc) GetRecursionDesired() bool {
 	return h.recursionDesired
 }
 
-// For HC we send to . IN NS +[no]rec message to the upstream. Dial timeouts and empty
-// replies are considered fails, basically anything else constitutes a healthy upstream.
+func (h *dnsHc) SetProbe(probe healthProbe) { h.probe = probe }
+
+// For HC we send to . IN NS +[no]rec message to the upstream, or the health_query of the group. Dial
+// timeouts and empty replies are considered fails, basically anything else constitutes a healthy upstream
+// unless the health_query expects an rcode or an answer.
 
 // Check is used as the up.Func in the up.Probe.
 func (h *dnsHc) Check(p *Proxy) error {
-	err := h.send(p.addr)
+	return checked(p, h.send(p.addr))
+}
+
+// checked records the result of a health check of p.
+func checked(p *Proxy, err error) error {
 	if err != nil {
 		HealthcheckFailureCount.WithLabelValues(p.addr).Add(1)
 		atomic.AddUint32(&p.fails, 1)
@@ -74,11 +96,19 @@ func (h *dnsHc) Check(p *Proxy) error {
 }
 
 func (h *dnsHc) send(addr string) error {
-	ping := new(dns.Msg)
-	ping.SetQuestion(".", dns.TypeNS)
-	ping.MsgHdr.RecursionDesired = h.recursionDesired
+	ping := h.probe.query(h.recursionDesired)
 
-	m, _, err := h.c.Exchange(ping, addr)
+	proto := h.c.Net
+	if proto == "udp" && (h.probe.tcp || !h.dialer.UDP()) {
+		proto = "tcp"
+	}
+	conn, err := dialDNS(h.dialer, proto, addr, h.c.TLSConfig, hcWriteTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	m, _, err := h.c.ExchangeWithConn(ping, conn)
 	// If we got a header, we're alright, basically only care about I/O errors 'n stuff.
 	if err != nil && m != nil {
 		// Silly check, something sane came back.
@@ -87,5 +117,32 @@ func (h *dnsHc) send(addr string) error {
 		}
 	}
 
-	return err
+	return h.probe.check(m, err)
+}
+
+// exchangeHc is a health checker for the upstreams reached through an exchanger (DoH, gRPC, DNSCrypt), the check is sent
+// with the exchanger of the proxy so it shares its connections and TLS settings.
+type exchangeHc struct {
+	recursionDesired bool
+	probe            healthProbe
+}
+
+func (h *exchangeHc) SetTLSConfig(*tls.Config) {}
+
+func (h *exchangeHc) SetRecursionDesired(recursionDesired bool) {
+	h.recursionDesired = recursionDesired
+}
+func (h *exchangeHc) GetRecursionDesired() bool {
+	return h.recursionDesired
+}
+
+func (h *exchangeHc) SetProbe(probe healthProbe) { h.probe = probe }
+
+// Check is used as the up.Func in the up.Probe.
+func (h *exchangeHc) Check(p *Proxy) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hcReadTimeout+hcWriteTimeout)
+	defer cancel()
+
+	m, err := p.exchanger.Exchange(ctx, h.probe.query(h.recursionDesired))
+	return checked(p, h.probe.check(m, err))
 }
@@ -0,0 +1,155 @@
+package turned
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultHedgeBudget is the number of hedged queries per second of a group when none is given.
+	defaultHedgeBudget = 100
+	// defaultHedgeDelay is the delay of hedge p95 while the upstream has too few response times measured.
+	defaultHedgeDelay = 150 * time.Millisecond
+)
+
+// hedge sends a query to the next upstream as well when the first one hasn't answered after the delay,
+// the first reply of both is the answer. At most budget queries are hedged per second.
+type hedge struct {
+	delay  time.Duration // 0 for the p95 response time of the upstream
+	budget int
+
+	mu     sync.Mutex
+	second int64 // the second spent is counted in
+	spent  int
+}
+
+// parseHedge parses hedge DELAY|p95 [BUDGET].
+func parseHedge(args []string) (*hedge, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return nil, fmt.Errorf("hedge DELAY|p95 [BUDGET] expected: %v", args)
+	}
+	h := &hedge{budget: defaultHedgeBudget}
+	if args[0] != "p95" {
+		dur, err := time.ParseDuration(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if dur <= 0 {
+			return nil, fmt.Errorf("hedge delay must be positive: %s", dur)
+		}
+		h.delay = dur
+	}
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, err
+		}
+		if n < 1 {
+			return nil, fmt.Errorf("hedge budget must be positive: %d", n)
+		}
+		h.budget = n
+	}
+	return h, nil
+}
+
+// delayFor returns how long the query to p runs alone.
+func (h *hedge) delayFor(p *Proxy) time.Duration {
+	if h.delay > 0 {
+		return h.delay
+	}
+	if d, ok := p.latency.percentile(0.95); ok {
+		return d
+	}
+	return defaultHedgeDelay
+}
+
+// allow spends a hedged query of the budget of the current second, if any is left.
+func (h *hedge) allow() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now().Unix()
+	if now != h.second {
+		h.second, h.spent = now, 0
+	}
+	if h.spent >= h.budget {
+		return false
+	}
+	h.spent++
+	return true
+}
+
+// nextUp returns the first healthy proxy of list from i on, but proxy, wrapping around. It returns its
+// index as well, past the end of list when it wrapped around.
+func (f *Forward) nextUp(list []*Proxy, i int, proxy *Proxy) (*Proxy, int) {
+	for j := i; j < i+len(list); j++ {
+		p := list[j%len(list)]
+		if p != proxy && !p.Down(f.maxfails) {
+			return p, j
+		}
+	}
+	return nil, 0
+}
+
+// hedged sends the query of state to proxy, and to next as well when proxy hasn't answered after the
+// hedge delay. It returns the first reply matching the query, the proxy which sent it and the number of
+// upstreams queried. Otherwise it returns a reply that didn't match if any came back, or else the error of
+// proxy, the caller checks its health, next is checked here.
+func (f *Forward) hedged(ctx context.Context, state request.Request, proxy, next *Proxy) (*dns.Msg, *Proxy, int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	out := f.newFanout(ctx, state, 2)
+	out.send(proxy)
+
+	timer := time.NewTimer(f.hedge.delayFor(proxy))
+	defer timer.Stop()
+
+	pending := 1
+	var failed, wrong *raceResult
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next == nil || !next.breaker.allow() {
+				continue
+			}
+			if !f.hedge.allow() {
+				HedgeBudgetExceededCount.Add(1)
+				continue
+			}
+			HedgeCount.WithLabelValues(next.addr).Add(1)
+			out.send(next)
+			pending++
+
+		case res := <-out.results:
+			pending--
+			switch {
+			case res.err == nil && state.Match(res.ret):
+				return res.ret, res.proxy, out.sent, nil
+			case res.err == nil:
+				// a reply not matching the query loses to the other one, as with race.
+				wrong = &res
+			case res.proxy == next:
+				if f.maxfails != 0 {
+					next.Healthcheck()
+				}
+			default:
+				failed = &res
+			}
+			// a failure before the delay moves on as without hedge.
+			if res.proxy == proxy && pending == 0 {
+				return res.ret, proxy, out.sent, res.err
+			}
+		}
+	}
+	if wrong != nil {
+		return wrong.ret, wrong.proxy, out.sent, nil
+	}
+	return failed.ret, proxy, out.sent, failed.err
+}
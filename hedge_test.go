@@ -0,0 +1,191 @@
+package turned
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHedge(t *testing.T) {
+	slow := newDelayedServer(t, "192.0.2.1", 500*time.Millisecond)
+	fast := newDelayedServer(t, "192.0.2.2", 0)
+	app := newTestApp(t, "policy sequential\nhedge 50ms", slow, fast)
+	hedges := testutil.ToFloat64(HedgeCount.WithLabelValues(fast))
+
+	ret, d, err := testQuery(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := answerIP(ret); ip != "192.0.2.2" {
+		t.Errorf("Expected the hedged upstream to answer, got %s", ip)
+	}
+	if d < 50*time.Millisecond || d > 300*time.Millisecond {
+		t.Errorf("Expected the reply after the hedge delay, took %s", d)
+	}
+	if n := testutil.ToFloat64(HedgeCount.WithLabelValues(fast)); n != hedges+1 {
+		t.Errorf("Expected a hedged query to %s", fast)
+	}
+}
+
+func TestHedgeNotNeeded(t *testing.T) {
+	first := newDelayedServer(t, "192.0.2.1", 0)
+	second := newDelayedServer(t, "192.0.2.2", 0)
+	app := newTestApp(t, "policy sequential\nhedge 200ms", first, second)
+	hedges := testutil.ToFloat64(HedgeCount.WithLabelValues(second))
+
+	if ret, _, err := testQuery(app); answerIP(ret) != "192.0.2.1" {
+		t.Errorf("Expected the first upstream to answer, got %v %v", ret, err)
+	}
+	if n := testutil.ToFloat64(HedgeCount.WithLabelValues(second)); n != hedges {
+		t.Error("Expected no hedged query")
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	slow := newDelayedServer(t, "192.0.2.1", 200*time.Millisecond)
+	fast := newDelayedServer(t, "192.0.2.2", 0)
+	app := newTestApp(t, "policy sequential\nhedge 20ms 1", slow, fast)
+
+	// the budget of the second may be spent by the first query only, wait for the start of one.
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	if ret, _, err := testQuery(app); answerIP(ret) != "192.0.2.2" {
+		t.Errorf("Expected the first query to be hedged, got %v %v", ret, err)
+	}
+	if ret, _, err := testQuery(app); answerIP(ret) != "192.0.2.1" {
+		t.Errorf("Expected the budget to be spent, got %v %v", ret, err)
+	}
+}
+
+func TestHedgeMaxAttempts(t *testing.T) {
+	slow := newDelayedServer(t, "192.0.2.1", 100*time.Millisecond)
+	fast := newDelayedServer(t, "192.0.2.2", 0)
+	// a hedged query counts as two attempts, a single one is left.
+	app := newTestApp(t, "policy sequential\nhedge 20ms\nmax_attempts 1", slow, fast)
+	hedges := testutil.ToFloat64(HedgeCount.WithLabelValues(fast))
+
+	if ret, _, err := testQuery(app); answerIP(ret) != "192.0.2.1" {
+		t.Errorf("Expected the first upstream to answer, got %v %v", ret, err)
+	}
+	if n := testutil.ToFloat64(HedgeCount.WithLabelValues(fast)); n != hedges {
+		t.Error("Expected no hedged query")
+	}
+}
+
+// newSilentServer starts a DNS server counting the queries for example.org. in n without answering them.
+func newSilentServer(t *testing.T, n *int32) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "example.org." {
+			atomic.AddInt32(n, 1)
+		}
+	})}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// newWrongServer starts a DNS server answering for another name than the one queried.
+func newWrongServer(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Question[0].Name = "wrong.example."
+		ret.Answer = append(ret.Answer, test.A("wrong.example. 3600 IN A 192.0.2.9"))
+		w.WriteMsg(ret)
+	})}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestHedgeWrongReply(t *testing.T) {
+	slow := newDelayedServer(t, "192.0.2.1", 100*time.Millisecond)
+	// the reply of the hedged upstream comes first but doesn't match the query.
+	app := newTestApp(t, "policy sequential\nhedge 20ms", slow, newWrongServer(t))
+
+	ret, _, err := testQuery(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := answerIP(ret); ip != "192.0.2.1" {
+		t.Errorf("Expected the matching reply of the first upstream, got %v", ret)
+	}
+}
+
+func TestHedgeSkipsNext(t *testing.T) {
+	var first, second int32
+	last := newDelayedServer(t, "192.0.2.3", 0)
+	app := newTestApp(t, "policy sequential\nhedge 20ms\nread_timeout 100ms",
+		newSilentServer(t, &first), newSilentServer(t, &second), last)
+
+	ret, _, err := testQuery(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := answerIP(ret); ip != "192.0.2.3" {
+		t.Errorf("Expected the last upstream to answer, got %v", ret)
+	}
+	// both hedged queries timed out, the second upstream isn't asked again.
+	if n := atomic.LoadInt32(&second); n != 1 {
+		t.Errorf("Expected a single query to the hedged upstream, got %d", n)
+	}
+}
+
+func TestHedgeP95(t *testing.T) {
+	p := NewProxy("10.0.0.1:53", "dns")
+	h := &hedge{budget: defaultHedgeBudget}
+	if d := h.delayFor(p); d != defaultHedgeDelay {
+		t.Errorf("Expected the default delay before any measure, got %s", d)
+	}
+	for i := 1; i <= 100; i++ {
+		p.latency.observe(time.Duration(i)*time.Millisecond, nil)
+	}
+	if d := h.delayFor(p); d < 94*time.Millisecond || d > 96*time.Millisecond {
+		t.Errorf("Expected a p95 of about 95ms, got %s", d)
+	}
+}
+
+func TestParseHedge(t *testing.T) {
+	tests := []struct {
+		args   string
+		delay  time.Duration
+		budget int
+		err    bool
+	}{
+		{"150ms", 150 * time.Millisecond, defaultHedgeBudget, false},
+		{"p95 20", 0, 20, false},
+		{"", 0, 0, true},
+		{"0s", 0, 0, true},
+		{"150ms 0", 0, 0, true},
+		{"150ms 1 2", 0, 0, true},
+	}
+	for _, tc := range tests {
+		app, err := parseTurned(caddy.NewTestController("dns", "turned hedge {\nto 1.1.1.1 8.8.8.8\nhedge "+tc.args+"\n}"))
+		if tc.err {
+			if err == nil {
+				t.Errorf("Expected an error for %q", tc.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", tc.args, err)
+		}
+		if h := app.Nodes[0].hedge; h.delay != tc.delay || h.budget != tc.budget {
+			t.Errorf("Expected hedge %s %d for %q, got %s %d", tc.delay, tc.budget, tc.args, h.delay, h.budget)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package turned
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyDecay is the weight of the last query in the moving averages of an upstream.
+	latencyDecay = 0.2
+	// latencySamples is the number of the last response times the percentiles are taken from.
+	latencySamples = 128
+	// minLatencySamples is the number of response times needed for a percentile.
+	minLatencySamples = 20
+)
+
+// latency keeps exponentially weighted moving averages of the response time of an upstream and of the
+// share of its queries that fail, and the last response times.
+type latency struct {
+	sync.Mutex
+	rtt     float64 // seconds, of the successful queries
+	errRate float64
+	queries bool // a query was observed
+	answers bool // a successful query was observed
+
+	recent [latencySamples]time.Duration // ring of the last response times
+	next   int
+	filled int
+}
+
+// observe adds a query which took d, or failed when err isn't nil.
+func (l *latency) observe(d time.Duration, err error) {
+	l.Lock()
+	defer l.Unlock()
+
+	failed := 0.0
+	if err != nil {
+		failed = 1
+	}
+	if l.queries {
+		l.errRate += latencyDecay * (failed - l.errRate)
+	} else {
+		l.errRate, l.queries = failed, true
+	}
+	if err != nil {
+		return
+	}
+	l.recent[l.next] = d
+	l.next = (l.next + 1) % latencySamples
+	if l.filled < latencySamples {
+		l.filled++
+	}
+	if l.answers {
+		l.rtt += latencyDecay * (d.Seconds() - l.rtt)
+	} else {
+		l.rtt, l.answers = d.Seconds(), true
+	}
+}
+
+// score is the expected cost of a query in seconds, the failures counting for timeout, the read timeout of
+// the upstream. An upstream not measured yet scores 0 so that it's measured first.
+func (l *latency) score(timeout time.Duration) float64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.rtt + l.errRate*timeout.Seconds()
+}
+
+// values returns the moving averages, rtt is 0 until a query succeeded.
+func (l *latency) values() (time.Duration, float64) {
+	l.Lock()
+	defer l.Unlock()
+	return time.Duration(l.rtt * float64(time.Second)), l.errRate
+}
+
+// percentile returns the q-th quantile of the last response times, ok is false until there are enough
+// of them.
+func (l *latency) percentile(q float64) (d time.Duration, ok bool) {
+	l.Lock()
+	if l.filled < minLatencySamples {
+		l.Unlock()
+		return 0, false
+	}
+	recent := make([]time.Duration, l.filled)
+	copy(recent, l.recent[:l.filled])
+	l.Unlock()
+
+	sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+	return recent[int(q*float64(len(recent)-1))], true
+}
@@ -0,0 +1,99 @@
+package turned
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestLatencyObserve(t *testing.T) {
+	var l latency
+	if s := l.score(time.Second); s != 0 {
+		t.Errorf("Expected an unmeasured upstream to score 0, got %f", s)
+	}
+
+	l.observe(100*time.Millisecond, nil)
+	if s := l.score(time.Second); math.Abs(s-0.1) > 1e-9 {
+		t.Errorf("Expected the first query to set the score, got %f", s)
+	}
+	l.observe(200*time.Millisecond, nil)
+	if s := l.score(time.Second); math.Abs(s-0.12) > 1e-9 {
+		t.Errorf("Expected a score of 0.12, got %f", s)
+	}
+
+	// a failure doesn't change the response time, it adds its share of a read timeout.
+	l.observe(time.Second, errors.New("timeout"))
+	want := 0.12 + latencyDecay*1
+	if s := l.score(time.Second); math.Abs(s-want) > 1e-9 {
+		t.Errorf("Expected a score of %f, got %f", want, s)
+	}
+}
+
+func TestFastestList(t *testing.T) {
+	slow, fast, failing, fresh := NewProxy("10.0.0.1:53", "dns"), NewProxy("10.0.0.2:53", "dns"),
+		NewProxy("10.0.0.3:53", "dns"), NewProxy("10.0.0.4:53", "dns")
+	for i := 0; i < 10; i++ {
+		slow.latency.observe(300*time.Millisecond, nil)
+		fast.latency.observe(10*time.Millisecond, nil)
+		failing.latency.observe(time.Millisecond, errors.New("refused"))
+	}
+	fast.latency.observe(10*time.Millisecond, nil)
+
+	p := &fastest{}
+	want := []*Proxy{fresh, fast, slow, failing}
+	explored := 0
+	const n = 2000
+	for i := 0; i < n; i++ {
+		list := p.List([]*Proxy{slow, failing, fast, fresh})
+		if list[0] != fresh {
+			explored++
+			continue
+		}
+		for j := range want {
+			if list[j] != want[j] {
+				t.Fatalf("Expected upstream %d to be %s, got %s", j, want[j].addr, list[j].addr)
+			}
+		}
+	}
+	// the others are tried first now and then.
+	if rate := float64(explored) / n; rate < exploreRate/2 || rate > exploreRate*2 {
+		t.Errorf("Expected about %.0f%% of the lists to explore, got %.1f%%", exploreRate*100, rate*100)
+	}
+}
+
+func TestFastestForward(t *testing.T) {
+	slow := newDelayedServer(t, "192.0.2.1", 50*time.Millisecond)
+	fast := newDelayedServer(t, "192.0.2.2", 0)
+
+	app, err := parseTurned(caddy.NewTestController("dns", "turned fastest {\nfrom .\nto "+slow+" "+fast+"\npolicy fastest\n}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range app.Nodes[0].proxies {
+		p.start(hcInterval)
+		defer p.stop()
+	}
+
+	answers := map[string]int{}
+	for i := 0; i < 40; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := app.ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Fatal(err)
+		}
+		answers[rec.Msg.Answer[0].(*dns.A).A.String()]++
+	}
+	// both are measured first, the fast one answers afterwards but when exploring.
+	if answers["192.0.2.1"] < 1 || answers["192.0.2.2"] < 30 {
+		t.Errorf("Expected the fast upstream to answer most queries, got %v", answers)
+	}
+}
@@ -64,4 +64,34 @@ var (
 		Name:      "conn_cache_misses_total",
 		Help:      "Counter of connection cache misses per upstream and protocol.",
 	}, []string{"to", "proto"})
+	HandshakeCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "conn_handshakes_total",
+		Help:      "Counter of connections dialed per upstream and protocol, for a query or to keep min_idle ones.",
+	}, []string{"to", "proto", "reason"})
+	RaceWinsCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "race_wins_total",
+		Help:      "Counter of the queries raced with policy race that each upstream answered first.",
+	}, []string{"to"})
+	CircuitStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "circuit_state",
+		Help:      "Gauge of the circuit breaker state per upstream, 1 for the current one of up, half_open and down.",
+	}, []string{"to", "state"})
+	HedgeCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "hedges_total",
+		Help:      "Counter of the queries sent to each upstream because the one before was too slow.",
+	}, []string{"to"})
+	HedgeBudgetExceededCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "hedge_budget_exceeded_total",
+		Help:      "Counter of the queries not hedged because the hedge budget of the second was spent.",
+	})
 )
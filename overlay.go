@@ -0,0 +1,233 @@
+package turned
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// overlayRule is a rule added at runtime, it sends Name to Group until Expire (if set).
+type overlayRule struct {
+	Name   string    `json:"name"`
+	Group  string    `json:"group"`
+	Expire time.Time `json:"expire"`
+
+	f *Forward
+}
+
+func (r *overlayRule) expired(now time.Time) bool {
+	return !r.Expire.IsZero() && now.After(r.Expire)
+}
+
+// ruleOverlay holds the rules added through the admin API. They sit on top of the rules of the groups:
+// a name found here is sent to its group before any group is tried.
+type ruleOverlay struct {
+	sync.RWMutex
+	rules map[string]*overlayRule
+
+	nodes []*Forward
+	file  string // when set the rules are persisted to this file
+}
+
+func newRuleOverlay() *ruleOverlay {
+	return &ruleOverlay{rules: map[string]*overlayRule{}}
+}
+
+// lookup returns the group d is sent to by an exact or wildcard overlay rule.
+func (o *ruleOverlay) lookup(d string) (*Forward, matchResult) {
+	o.RLock()
+	defer o.RUnlock()
+
+	if len(o.rules) == 0 {
+		return nil, matchResult{}
+	}
+
+	now := time.Now()
+	if r, ok := o.rules[d]; ok && !r.expired(now) {
+		return r.f, matchResult{Kind: matchOverlay, Rule: r.Name}
+	}
+	for _, dn := range GetWild(d) {
+		if r, ok := o.rules[dn]; ok && !r.expired(now) {
+			return r.f, matchResult{Kind: matchOverlayWildcard, Rule: r.Name}
+		}
+	}
+	return nil, matchResult{}
+}
+
+func (o *ruleOverlay) node(group string) *Forward {
+	for _, f := range o.nodes {
+		if f.Name() == group {
+			return f
+		}
+	}
+	return nil
+}
+
+// normalizeRule lowers name and strips the final dot the way the queried names are, a leading "*." makes
+// it a wildcard rule.
+func normalizeRule(name string) (string, error) {
+	name = PureDomain(strings.TrimSpace(name))
+	if name == "" || name == "*" || strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+		return "", fmt.Errorf("invalid rule: %q", name)
+	}
+	return name, nil
+}
+
+// add sets the rule for name, replacing any existing one. When the rules can't be saved the former rule is
+// restored, the rule is returned with the error.
+func (o *ruleOverlay) add(name, group string, expire time.Time) (*overlayRule, error) {
+	name, err := normalizeRule(name)
+	if err != nil {
+		return nil, err
+	}
+	f := o.node(group)
+	if f == nil {
+		return nil, fmt.Errorf("unknown group: %q", group)
+	}
+
+	r := &overlayRule{Name: name, Group: group, Expire: expire, f: f}
+
+	o.Lock()
+	defer o.Unlock()
+	prev, replaced := o.rules[name]
+	o.rules[name] = r
+	if err := o.save(); err != nil {
+		if replaced {
+			o.rules[name] = prev
+		} else {
+			delete(o.rules, name)
+		}
+		return r, err
+	}
+	return r, nil
+}
+
+// remove deletes the rule for name, it reports whether there was one. When the rules can't be saved the rule
+// is restored.
+func (o *ruleOverlay) remove(name string) (bool, error) {
+	name, err := normalizeRule(name)
+	if err != nil {
+		return false, err
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	r, ok := o.rules[name]
+	if !ok {
+		return false, nil
+	}
+	delete(o.rules, name)
+	if err := o.save(); err != nil {
+		o.rules[name] = r
+		return true, err
+	}
+	return true, nil
+}
+
+// list returns the rules that did not expire, sorted by name. Expired rules are dropped.
+func (o *ruleOverlay) list() ([]*overlayRule, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	now := time.Now()
+	rules := make([]*overlayRule, 0, len(o.rules))
+	dropped := false
+	for name, r := range o.rules {
+		if r.expired(now) {
+			delete(o.rules, name)
+			dropped = true
+			continue
+		}
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+
+	if dropped {
+		return rules, o.save()
+	}
+	return rules, nil
+}
+
+// load reads the rules persisted in o.file. A missing file is not an error, rules for unknown groups
+// and expired rules are skipped.
+func (o *ruleOverlay) load() error {
+	if o.file == "" {
+		return nil
+	}
+
+	buf, err := os.ReadFile(o.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var rules []*overlayRule
+	if err := json.Unmarshal(buf, &rules); err != nil {
+		return fmt.Errorf("%s: %s", o.file, err)
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	now := time.Now()
+	for _, r := range rules {
+		if r.expired(now) {
+			continue
+		}
+		name, err := normalizeRule(r.Name)
+		if err != nil {
+			log.Warningf("[Overlay] skip %s", err)
+			continue
+		}
+		if r.f = o.node(r.Group); r.f == nil {
+			log.Warningf("[Overlay] skip rule %s for unknown group %s", name, r.Group)
+			continue
+		}
+		r.Name = name
+		o.rules[name] = r
+	}
+	log.Infof("[Settings] overlay loaded %d rules from %s", len(o.rules), o.file)
+	return nil
+}
+
+// save writes the rules to o.file, o must be locked.
+func (o *ruleOverlay) save() error {
+	if o.file == "" {
+		return nil
+	}
+
+	rules := make([]*overlayRule, 0, len(o.rules))
+	for _, r := range o.rules {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+
+	buf, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write aside and rename, so a crash never leaves a truncated file behind.
+	tmp, err := os.CreateTemp(filepath.Dir(o.file), filepath.Base(o.file)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), o.file)
+}
@@ -3,6 +3,7 @@ package turned
 import (
 	"crypto/tls"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -16,72 +17,164 @@ type persistConn struct {
 
 // Transport hold the persistent cache.
 type Transport struct {
-	avgDialTime int64                          // kind of average time of dial time
-	conns       [typeTotalCount][]*persistConn // Buckets for udp, tcp and tcp-tls.
-	expire      time.Duration                  // After this duration a connection is expired.
-	addr        string
-	tlsConfig   *tls.Config
-
-	dial  chan string
-	yield chan *persistConn
-	ret   chan *persistConn
-	stop  chan bool
+	avgDialTime  int64                    // kind of average time of dial time
+	avgReadTime  int64                    // kind of average response time, for the tuned read timeout
+	pools        [typeTotalCount]connPool // Buckets for udp, tcp, tcp-tls and unix.
+	expire       time.Duration            // After this duration a connection is expired.
+	addr         string
+	tlsConfig    *tls.Config
+	unix         bool // addr is the path of a unix socket
+	dialer       dialer
+	pipeline     *pipeline // set when the TCP and TLS queries are pipelined
+	minIdle      int       // number of TCP, TLS or unix connections kept open
+	minIdleProto string    // the protocol of the queries, udp unless force_tcp
+
+	fixedDialTimeout time.Duration // 0 when tuned from avgDialTime
+
+	stop chan bool
 }
 
 func newTransport(addr string) *Transport {
 	t := &Transport{
 		avgDialTime: int64(maxDialTimeout / 2),
-		conns:       [typeTotalCount][]*persistConn{},
+		avgReadTime: int64(readTimeout / 2),
 		expire:      defaultExpire,
 		addr:        addr,
-		dial:        make(chan string),
-		yield:       make(chan *persistConn),
-		ret:         make(chan *persistConn),
+		dialer:      directDialer{},
 		stop:        make(chan bool),
 	}
 	return t
 }
 
-// connManagers manages the persistent connection cache for UDP and TCP.
-func (t *Transport) connManager() {
+// connPool is the cache of a transport type. The connections are stacked in the order they are
+// yielded, so they are sorted by "used" and the last one is the most recently used.
+type connPool struct {
+	sync.Mutex
+	conns   []*persistConn
+	stopped bool
+}
+
+// get takes the most recently used connection out of the pool, if it didn't expire. When it did, all
+// the connections expired and are closed.
+func (p *connPool) get(expire time.Duration) *persistConn {
+	p.Lock()
+	defer p.Unlock()
+
+	n := len(p.conns)
+	if n == 0 {
+		return nil
+	}
+	pc := p.conns[n-1]
+	if time.Since(pc.used) < expire {
+		p.conns[n-1] = nil
+		p.conns = p.conns[:n-1]
+		return pc
+	}
+	// clear entire cache if the last conn is expired
+	stale := p.conns
+	p.conns = nil
+	// now, the connections being passed to closeConns() are not reachable groupName
+	// transport methods anymore. So, it's safe to close them in a separate goroutine
+	go closeConns(stale)
+	return nil
+}
+
+// fresh returns the number of connections used after since.
+func (p *connPool) fresh(since time.Time) int {
+	p.Lock()
+	defer p.Unlock()
+	// connections in stack are sorted by "used"
+	return len(p.conns) - sort.Search(len(p.conns), func(i int) bool {
+		return p.conns[i].used.After(since)
+	})
+}
+
+// put adds pc to the pool, or closes it once the transport stopped.
+func (p *connPool) put(pc *persistConn) {
+	p.Lock()
+	if p.stopped {
+		p.Unlock()
+		pc.c.Close()
+		return
+	}
+	p.conns = append(p.conns, pc)
+	p.Unlock()
+}
+
+// cleanup removes the connections not used since staleTime, all of them and for good when stop is set.
+func (p *connPool) cleanup(staleTime time.Time, stop bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if stop {
+		p.stopped = true
+		go closeConns(p.conns)
+		p.conns = nil
+		return
+	}
+	if len(p.conns) == 0 || p.conns[0].used.After(staleTime) {
+		return
+	}
+
+	// connections in stack are sorted by "used"
+	good := sort.Search(len(p.conns), func(i int) bool {
+		return p.conns[i].used.After(staleTime)
+	})
+	stale := p.conns[:good]
+	p.conns = append([]*persistConn(nil), p.conns[good:]...)
+	go closeConns(stale)
+}
+
+// manage expires the idle connections until the transport stops. With min_idle it also keeps that many
+// connections fresh, a new one is dialed before the last fresh one expires.
+func (t *Transport) manage() {
 	ticker := time.NewTicker(defaultExpire)
-Wait:
+	defer ticker.Stop()
+
+	var warm <-chan time.Time
+	if t.minIdle > 0 {
+		t.warm()
+		warmTicker := time.NewTicker(t.expire / 2)
+		defer warmTicker.Stop()
+		warm = warmTicker.C
+	}
+
 	for {
 		select {
-		case proto := <-t.dial:
-			transtype := stringToTransportType(proto)
-			// take the last used conn - complexity O(1)
-			if stack := t.conns[transtype]; len(stack) > 0 {
-				pc := stack[len(stack)-1]
-				if time.Since(pc.used) < t.expire {
-					// Found one, remove groupName pool and return this conn.
-					t.conns[transtype] = stack[:len(stack)-1]
-					t.ret <- pc
-					continue Wait
-				}
-				// clear entire cache if the last conn is expired
-				t.conns[transtype] = nil
-				// now, the connections being passed to closeConns() are not reachable groupName
-				// transport methods anymore. So, it's safe to close them in a separate goroutine
-				go closeConns(stack)
-			}
-			t.ret <- nil
-
-		case pc := <-t.yield:
-			transtype := t.transportTypeFromConn(pc)
-			t.conns[transtype] = append(t.conns[transtype], pc)
-
 		case <-ticker.C:
 			t.cleanup(false)
-
+		case <-warm:
+			t.warm()
 		case <-t.stop:
-			t.cleanup(true)
-			close(t.ret)
 			return
 		}
 	}
 }
 
+// warm dials connections until t.minIdle of them were used, or dialed, in the last half of t.expire.
+// They are then still cached when warm runs again.
+func (t *Transport) warm() {
+	proto := t.proto(t.minIdleProto)
+	if proto == "udp" {
+		// the queries don't use connections kept open.
+		return
+	}
+	if t.pipeline != nil {
+		t.pipeline.warm(t, proto, t.minIdle)
+		return
+	}
+
+	fresh := t.pools[stringToTransportType(proto)].fresh(time.Now().Add(-t.expire / 2))
+	for i := fresh; i < t.minIdle; i++ {
+		conn, err := t.dialConn(proto, "warm")
+		if err != nil {
+			// the health check reports the upstream down, try again next time.
+			return
+		}
+		t.Yield(&persistConn{c: conn})
+	}
+}
+
 // closeConns closes connections.
 func closeConns(conns []*persistConn) {
 	for _, pc := range conns {
@@ -92,55 +185,28 @@ func closeConns(conns []*persistConn) {
 // cleanup removes connections groupName cache.
 func (t *Transport) cleanup(all bool) {
 	staleTime := time.Now().Add(-t.expire)
-	for transtype, stack := range t.conns {
-		if len(stack) == 0 {
-			continue
-		}
-		if all {
-			t.conns[transtype] = nil
-			// now, the connections being passed to closeConns() are not reachable groupName
-			// transport methods anymore. So, it's safe to close them in a separate goroutine
-			go closeConns(stack)
-			continue
-		}
-		if stack[0].used.After(staleTime) {
-			continue
-		}
-
-		// connections in stack are sorted by "used"
-		good := sort.Search(len(stack), func(i int) bool {
-			return stack[i].used.After(staleTime)
-		})
-		t.conns[transtype] = stack[good:]
-		// now, the connections being passed to closeConns() are not reachable groupName
-		// transport methods anymore. So, it's safe to close them in a separate goroutine
-		go closeConns(stack[:good])
+	for i := range t.pools {
+		t.pools[i].cleanup(staleTime, all)
 	}
 }
 
-// It is hard to pin a value to this, the import thing is to no block forever, losing at cached connection is not terrible.
-const yieldTimeout = 25 * time.Millisecond
-
 // Yield returns the connection to transport for reuse.
 func (t *Transport) Yield(pc *persistConn) {
 	pc.used = time.Now() // update used time
-
-	// Make this non-blocking, because in the case of a very busy forwarder we will *block* on this yield. This
-	// blocks the outer go-routine and stuff will just pile up.  We timeout when the send fails to as returning
-	// these connection is an optimization anyway.
-	select {
-	case t.yield <- pc:
-		return
-	case <-time.After(yieldTimeout):
-		return
-	}
+	t.pools[t.transportTypeFromConn(pc)].put(pc)
 }
 
-// Start starts the transport's connection manager.
-func (t *Transport) Start() { go t.connManager() }
+// Start starts expiring the idle connections of transport.
+func (t *Transport) Start() { go t.manage() }
 
-// Stop stops the transport's connection manager.
-func (t *Transport) Stop() { close(t.stop) }
+// Stop closes the connections of transport, the ones yielded afterwards are closed right away.
+func (t *Transport) Stop() {
+	close(t.stop)
+	t.cleanup(true)
+	if t.pipeline != nil {
+		t.pipeline.close()
+	}
+}
 
 // SetExpire sets the connection expire time in transport.
 func (t *Transport) SetExpire(expire time.Duration) { t.expire = expire }
@@ -148,6 +214,16 @@ func (t *Transport) SetExpire(expire time.Duration) { t.expire = expire }
 // SetTLSConfig sets the TLS config in transport.
 func (t *Transport) SetTLSConfig(cfg *tls.Config) { t.tlsConfig = cfg }
 
+// SetMinIdle sets the number of TCP, TLS or unix connections transport keeps open. proto is the protocol
+// the queries are sent over, nothing is kept open when they go over UDP.
+func (t *Transport) SetMinIdle(n int, proto string) { t.minIdle, t.minIdleProto = n, proto }
+
+// SetDialer sets the dialer opening the connections of transport.
+func (t *Transport) SetDialer(d dialer) { t.dialer = d }
+
+// SetDialTimeout sets the dial timeout, 0 tunes it from the dial times.
+func (t *Transport) SetDialTimeout(timeout time.Duration) { t.fixedDialTimeout = timeout }
+
 const (
 	defaultExpire  = 10 * time.Second
 	minDialTimeout = 1 * time.Second
@@ -158,4 +234,9 @@ const (
 var (
 	// Some resolves might take quite a while, usually (cached) responses are fast. Set to 2s to give us some time to retry a different upstream.
 	readTimeout = 2 * time.Second
+	// minReadTimeout is the lowest tuned read timeout, with read_timeout auto.
+	minReadTimeout = 250 * time.Millisecond
 )
+
+// tunedReadTimeout is the read timeout set by read_timeout auto, it's tuned from the response times.
+const tunedReadTimeout time.Duration = -1
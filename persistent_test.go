@@ -0,0 +1,286 @@
+package turned
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestConn() *persistConn {
+	c, _ := net.Pipe()
+	return &persistConn{c: &dns.Conn{Conn: c}}
+}
+
+func TestTransportPool(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	tr := newTransport(ln.Addr().String())
+	tr.Start()
+	defer tr.Stop()
+
+	pc, cached, err := tr.Dial("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.c.Close()
+	if cached {
+		t.Fatal("Expected no cached connection")
+	}
+
+	first, second := newTestConn(), newTestConn()
+	tr.Yield(first)
+	tr.Yield(second)
+
+	// the most recently used connection comes first.
+	if pc, cached, _ := tr.Dial("tcp"); !cached || pc != second {
+		t.Errorf("Expected the last yielded connection")
+	}
+	if pc, cached, _ := tr.Dial("tcp"); !cached || pc != first {
+		t.Errorf("Expected the first yielded connection")
+	}
+	if pc := tr.pools[typeUDP].get(tr.expire); pc != nil {
+		t.Errorf("Expected no UDP connection")
+	}
+}
+
+func TestTransportPoolExpire(t *testing.T) {
+	tr := newTransport("127.0.0.1:53")
+	tr.SetExpire(10 * time.Millisecond)
+
+	tr.Yield(newTestConn())
+	tr.Yield(newTestConn())
+	time.Sleep(20 * time.Millisecond)
+	tr.Yield(newTestConn())
+
+	tr.cleanup(false)
+	if n := len(tr.pools[typeTCP].conns); n != 1 {
+		t.Errorf("Expected 1 connection after cleanup, got %d", n)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	// the expired last connection clears the whole pool.
+	if pc := tr.pools[typeTCP].get(tr.expire); pc != nil {
+		t.Error("Expected no connection once expired")
+	}
+	if n := len(tr.pools[typeTCP].conns); n != 0 {
+		t.Errorf("Expected an empty pool, got %d", n)
+	}
+}
+
+func TestTransportPoolContention(t *testing.T) {
+	tr := newTransport("127.0.0.1:53")
+	tr.Start()
+	defer tr.Stop()
+
+	const n = 1000
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tr.Yield(newTestConn())
+		}()
+	}
+	wg.Wait()
+
+	// no connection is dropped, however busy the transport is.
+	if got := len(tr.pools[typeTCP].conns); got != n {
+		t.Errorf("Expected %d cached connections, got %d", n, got)
+	}
+}
+
+func TestTransportPoolStop(t *testing.T) {
+	tr := newTransport("127.0.0.1:53")
+	tr.Start()
+	tr.Yield(newTestConn())
+	tr.Stop()
+
+	tr.Yield(newTestConn())
+	if pc := tr.pools[typeTCP].get(tr.expire); pc != nil {
+		t.Error("Expected no connection after stop")
+	}
+}
+
+func TestTransportMinIdle(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var accepted int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			c.Close()
+		}
+	}()
+
+	tr := newTransport(l.Addr().String())
+	tr.SetExpire(200 * time.Millisecond)
+	tr.SetMinIdle(2, "tcp")
+	tr.Start()
+	defer tr.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+	if n := tr.pools[typeTCP].fresh(time.Now().Add(-tr.expire)); n != 2 {
+		t.Errorf("Expected 2 idle connections, got %d", n)
+	}
+
+	// the connections are dialed again before they expire.
+	time.Sleep(300 * time.Millisecond)
+	if n := tr.pools[typeTCP].fresh(time.Now().Add(-tr.expire)); n < 2 {
+		t.Errorf("Expected 2 fresh connections, got %d", n)
+	}
+	if n := atomic.LoadInt32(&accepted); n < 4 {
+		t.Errorf("Expected the connections to be refreshed, got %d dials", n)
+	}
+	if pc, cached, _ := tr.Dial("tcp"); !cached {
+		t.Error("Expected a warm connection")
+	} else {
+		tr.Yield(pc)
+	}
+}
+
+func TestTransportMinIdleUDP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var accepted int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			c.Close()
+		}
+	}()
+
+	tr := newTransport(l.Addr().String())
+	tr.SetExpire(200 * time.Millisecond)
+	tr.SetMinIdle(2, "udp")
+	tr.Start()
+	defer tr.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&accepted); n != 0 {
+		t.Errorf("Expected no connection kept open for the UDP queries, got %d dials", n)
+	}
+}
+
+// chanTransport is the former connection cache, every Dial and Yield went through the connManager
+// goroutine. It's kept to compare the pools.
+type chanTransport struct {
+	conns  [typeTotalCount][]*persistConn
+	expire time.Duration
+
+	dial  chan string
+	yield chan *persistConn
+	ret   chan *persistConn
+	stop  chan bool
+
+	dropped int64
+}
+
+func newChanTransport() *chanTransport {
+	t := &chanTransport{
+		expire: defaultExpire,
+		dial:   make(chan string),
+		yield:  make(chan *persistConn),
+		ret:    make(chan *persistConn),
+		stop:   make(chan bool),
+	}
+	go t.connManager()
+	return t
+}
+
+func (t *chanTransport) connManager() {
+	for {
+		select {
+		case proto := <-t.dial:
+			transtype := stringToTransportType(proto)
+			if stack := t.conns[transtype]; len(stack) > 0 {
+				pc := stack[len(stack)-1]
+				if time.Since(pc.used) < t.expire {
+					t.conns[transtype] = stack[:len(stack)-1]
+					t.ret <- pc
+					continue
+				}
+				t.conns[transtype] = nil
+			}
+			t.ret <- nil
+
+		case pc := <-t.yield:
+			t.conns[typeTCP] = append(t.conns[typeTCP], pc)
+
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+func (t *chanTransport) get(proto string) *persistConn {
+	t.dial <- proto
+	return <-t.ret
+}
+
+func (t *chanTransport) put(pc *persistConn) {
+	pc.used = time.Now()
+	select {
+	case t.yield <- pc:
+	case <-time.After(yieldTimeout):
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+// yieldTimeout is how long the former Yield waited for the connManager before dropping the connection.
+const yieldTimeout = 25 * time.Millisecond
+
+// benchmarkPool takes a connection out of the pool and gives it back, dialing (a pipe) on a miss.
+func benchmarkPool(b *testing.B, get func() *persistConn, put func(*persistConn)) {
+	var misses int64
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			pc := get()
+			if pc == nil {
+				atomic.AddInt64(&misses, 1)
+				pc = newTestConn()
+			}
+			put(pc)
+		}
+	})
+	b.ReportMetric(float64(misses)/float64(b.N), "misses/op")
+}
+
+func BenchmarkTransportPool(b *testing.B) {
+	b.Run("mutex", func(b *testing.B) {
+		tr := newTransport("127.0.0.1:53")
+		tr.Start()
+		defer tr.Stop()
+		pool := &tr.pools[typeTCP]
+		benchmarkPool(b, func() *persistConn { return pool.get(tr.expire) }, tr.Yield)
+	})
+
+	b.Run("channel", func(b *testing.B) {
+		tr := newChanTransport()
+		defer close(tr.stop)
+		benchmarkPool(b, func() *persistConn { return tr.get("tcp") }, tr.put)
+		b.ReportMetric(float64(atomic.LoadInt64(&tr.dropped))/float64(b.N), "dropped/op")
+	})
+}
@@ -0,0 +1,107 @@
+package turned
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+)
+
+// errPinMismatch is returned by the handshakes with a server presenting none of the pinned keys.
+var errPinMismatch = errors.New("no certificate matches the pinned public keys")
+
+// parsePin parses `pin sha256/<base64> [UPSTREAM...]`, without upstreams the pin applies to the whole
+// group. Repeating the property adds backup pins.
+func parsePin(c *caddy.Controller, f *Forward) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	pin, err := decodePin(c.Val())
+	if err != nil {
+		return err
+	}
+
+	upstreams := c.RemainingArgs()
+	if len(upstreams) == 0 {
+		upstreams = []string{""}
+	}
+	for _, u := range upstreams {
+		addr := ""
+		if u != "" {
+			if addr, err = upstreamAddr(u); err != nil {
+				return fmt.Errorf("pin: %s", err)
+			}
+		}
+		if f.pins == nil {
+			f.pins = map[string][][]byte{}
+		}
+		f.pins[addr] = append(f.pins[addr], pin)
+	}
+	return nil
+}
+
+// decodePin decodes sha256/<base64>, the base64 of the SHA-256 of the SubjectPublicKeyInfo of a
+// certificate, like `openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64`.
+func decodePin(s string) ([]byte, error) {
+	b64, ok := strings.CutPrefix(s, "sha256/")
+	if !ok {
+		return nil, fmt.Errorf("pin: expected sha256/<base64>: %q", s)
+	}
+	pin, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("pin: %s", err)
+	}
+	if len(pin) != sha256.Size {
+		return nil, fmt.Errorf("pin: not a SHA-256 hash: %q", s)
+	}
+	return pin, nil
+}
+
+// pinsFor returns the pins of the upstream addr, its own pins replace the ones of the group.
+func (f *Forward) pinsFor(addr string) [][]byte {
+	if pins, ok := f.pins[addr]; ok {
+		return pins
+	}
+	return f.pins[""]
+}
+
+// usesTLS reports whether the connections to p are TLS ones, tlsEnabled tells whether the group sets tls.
+func (p *Proxy) usesTLS(tlsEnabled bool) bool {
+	switch p.trans {
+	case transport.TLS, transport.HTTPS, transportQUIC:
+		return true
+	case transport.GRPC:
+		return tlsEnabled
+	}
+	return false
+}
+
+// pinnedTLSConfig returns a copy of cfg whose handshakes fail unless a certificate of the server has the
+// public key of one of pins. It's checked on resumed sessions as well.
+func pinnedTLSConfig(cfg *tls.Config, pins [][]byte) *tls.Config {
+	cfg = cfg.Clone()
+	verify := cfg.VerifyConnection
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		for _, cert := range cs.PeerCertificates {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(sum[:], pin) {
+					return nil
+				}
+			}
+		}
+		return errPinMismatch
+	}
+	return cfg
+}
@@ -0,0 +1,126 @@
+package turned
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// newDoTServer starts a DNS-over-TLS server answering every query with 192.0.2.1.
+func newDoTServer(t *testing.T, cert tls.Certificate) string {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dns.Server{Listener: ln, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" 3600 IN A 192.0.2.1"))
+		w.WriteMsg(ret)
+	})}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+	return ln.Addr().String()
+}
+
+func TestPin(t *testing.T) {
+	cert, pool := newTestCert(t)
+	addr := newDoTServer(t, cert)
+
+	sum := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	good := "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+	bad := "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		pins []string
+		err  error
+	}{
+		{[]string{good}, nil},
+		{[]string{bad, good}, nil},
+		{[]string{bad}, errPinMismatch},
+	}
+	for _, tt := range tests {
+		p := NewProxy(addr, "tls")
+		for _, pin := range tt.pins {
+			b, err := decodePin(pin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.pins = append(p.pins, b)
+		}
+		p.SetTLSConfig(&tls.Config{RootCAs: pool, ServerName: "dns.example"})
+		p.start(hcInterval)
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		_, err := p.Connect(context.Background(), request.Request{W: &test.ResponseWriter{}, Req: m}, options{})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%v: expected %v, got %v", tt.pins, tt.err, err)
+		}
+		if err := p.health.Check(p); !errors.Is(err, tt.err) {
+			t.Errorf("%v: expected health check %v, got %v", tt.pins, tt.err, err)
+		}
+		p.stop()
+	}
+}
+
+func TestParsePerUpstreamTLS(t *testing.T) {
+	pin := "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	c := caddy.NewTestController("dns", `turned tls {
+		from .
+		to "tls://1.1.1.1#cloudflare-dns.com" "tls://8.8.8.8#dns.google" tls://9.9.9.9
+		tls_servername dns.quad9.net
+		pin `+pin+` "tls://8.8.8.8#dns.google"
+	}`)
+	app, err := parseTurned(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serverName string
+		pins       int
+	}{
+		{"cloudflare-dns.com", 0},
+		{"dns.google", 1},
+		{"dns.quad9.net", 0},
+	}
+	for i, p := range app.Nodes[0].proxies {
+		if sni := p.transport.tlsConfig.ServerName; sni != tests[i].serverName {
+			t.Errorf("%s: expected server name %s, got %s", p.addr, tests[i].serverName, sni)
+		}
+		if len(p.pins) != tests[i].pins {
+			t.Errorf("%s: expected %d pins, got %d", p.addr, tests[i].pins, len(p.pins))
+		}
+	}
+}
+
+func TestParsePinError(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"to tls://1.1.1.1\npin 0123", "sha256/"},
+		{"to tls://1.1.1.1\npin sha256/AAAA", "not a SHA-256"},
+		{"to 1.1.1.1\npin sha256/" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size)), "needs a TLS upstream"},
+		{"to tls://1.1.1.1\npin sha256/" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size)) + " tls://8.8.8.8", "unknown upstream"},
+		{`to "1.1.1.1#one.one.one.one"`, "only supported for tls://"},
+	}
+	for _, tt := range tests {
+		c := caddy.NewTestController("dns", "turned tls {\nfrom .\n"+tt.input+"\n}")
+		_, err := parseTurned(c)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.input, tt.err, err)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package turned
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxPipelined is the number of queries in flight on a pipelined connection before another one is dialed.
+const maxPipelined = 64
+
+// errPipelineTimeout is returned when the reply to a pipelined query didn't come in time.
+var errPipelineTimeout = errors.New("timeout waiting for the pipelined reply")
+
+// pipeline keeps the pipelined TCP and TLS connections of a transport (RFC 7766 6.2.1.1). Concurrent
+// queries share a connection instead of taking one each out of the cache.
+type pipeline struct {
+	sync.Mutex
+	conns map[string][]*pipelineConn // by "tcp" or "tcp-tls"
+
+	dialMu sync.Mutex
+}
+
+func newPipeline() *pipeline {
+	return &pipeline{conns: map[string][]*pipelineConn{}}
+}
+
+// get returns a connection for proto with room for another query, cached reports whether it was already open.
+func (pl *pipeline) get(t *Transport, proto string) (*pipelineConn, bool, error) {
+	if pc := pl.available(proto); pc != nil {
+		ConnCacheHitsCount.WithLabelValues(t.addr, proto).Add(1)
+		return pc, true, nil
+	}
+
+	// dial one connection at a time, the queries waiting meanwhile share it.
+	pl.dialMu.Lock()
+	defer pl.dialMu.Unlock()
+	if pc := pl.available(proto); pc != nil {
+		ConnCacheHitsCount.WithLabelValues(t.addr, proto).Add(1)
+		return pc, true, nil
+	}
+	ConnCacheMissesCount.WithLabelValues(t.addr, proto).Add(1)
+
+	pc, err := pl.dial(t, proto, "query")
+	return pc, false, err
+}
+
+func (pl *pipeline) dial(t *Transport, proto, reason string) (*pipelineConn, error) {
+	conn, err := t.dialConn(proto, reason)
+	if err != nil {
+		return nil, err
+	}
+	// the queries raise the wait to their read timeout.
+	pc := newPipelineConn(conn, t.expire, 0)
+
+	pl.Lock()
+	pl.conns[proto] = append(pl.conns[proto], pc)
+	pl.Unlock()
+	return pc, nil
+}
+
+// warm dials connections for proto until n of them take new queries.
+func (pl *pipeline) warm(t *Transport, proto string, n int) {
+	pl.dialMu.Lock()
+	defer pl.dialMu.Unlock()
+
+	pl.available(proto) // drops the closed ones
+	pl.Lock()
+	open := 0
+	for _, pc := range pl.conns[proto] {
+		if pc.open() {
+			open++
+		}
+	}
+	pl.Unlock()
+
+	for ; open < n; open++ {
+		if _, err := pl.dial(t, proto, "warm"); err != nil {
+			return
+		}
+	}
+}
+
+// available returns an open connection for proto with room for another query, the closed ones are dropped.
+func (pl *pipeline) available(proto string) *pipelineConn {
+	pl.Lock()
+	defer pl.Unlock()
+
+	var pc *pipelineConn
+	conns := pl.conns[proto][:0]
+	for _, c := range pl.conns[proto] {
+		if c.closed() {
+			continue
+		}
+		conns = append(conns, c)
+		if pc == nil && c.available() {
+			pc = c
+		}
+	}
+	pl.conns[proto] = conns
+	return pc
+}
+
+// close closes all the connections.
+func (pl *pipeline) close() {
+	pl.Lock()
+	defer pl.Unlock()
+	for proto, conns := range pl.conns {
+		for _, pc := range conns {
+			pc.close(io.EOF)
+		}
+		delete(pl.conns, proto)
+	}
+}
+
+// pipelineConn is a connection shared by concurrent queries. The queries are written as they come with
+// an ID unique on the connection, a reader goroutine hands the replies over by ID. The connection is
+// closed once idle for the keepalive timeout of the server (RFC 7828) or the expire of the group.
+type pipelineConn struct {
+	c   *dns.Conn
+	wmu sync.Mutex // serializes the writes
+
+	mu       sync.Mutex
+	pending  map[uint16]chan *dns.Msg
+	idle     time.Duration
+	wait     time.Duration // the longest a query waits for its reply, the connection isn't idle before
+	draining bool          // the server asked to close the connection, no new queries
+	err      error         // set once closed
+}
+
+func newPipelineConn(c *dns.Conn, idle, wait time.Duration) *pipelineConn {
+	pc := &pipelineConn{c: c, pending: map[uint16]chan *dns.Msg{}, idle: idle, wait: wait}
+	pc.touch()
+	go pc.read()
+	return pc
+}
+
+func (pc *pipelineConn) closed() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.err != nil
+}
+
+// open reports whether pc takes new queries.
+func (pc *pipelineConn) open() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.err == nil && !pc.draining
+}
+
+func (pc *pipelineConn) available() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.err == nil && !pc.draining && len(pc.pending) < maxPipelined
+}
+
+// touch pushes the idle timeout back, pc.mu must be held or pc not shared yet.
+func (pc *pipelineConn) touch() {
+	d := pc.idle
+	if d < pc.wait {
+		d = pc.wait
+	}
+	pc.c.SetReadDeadline(time.Now().Add(d))
+}
+
+// exchange sends m and waits timeout for its reply. cached tells whether the connection was used before, a
+// query failing because the server closed it meanwhile then returns ErrCachedClosed so it's tried again.
+func (pc *pipelineConn) exchange(m *dns.Msg, cached bool, timeout time.Duration) (*dns.Msg, error) {
+	req, keepalive := withKeepalive(m)
+	buf, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *dns.Msg, 1)
+	pc.mu.Lock()
+	if pc.err != nil || pc.draining {
+		pc.mu.Unlock()
+		return nil, ErrCachedClosed
+	}
+	id := pc.newID()
+	pc.pending[id] = ch
+	if timeout > pc.wait {
+		pc.wait = timeout
+	}
+	pc.touch()
+	pc.mu.Unlock()
+	binary.BigEndian.PutUint16(buf, id)
+
+	pc.wmu.Lock()
+	pc.c.SetWriteDeadline(time.Now().Add(maxTimeout))
+	_, err = pc.c.Write(buf)
+	pc.wmu.Unlock()
+	if err != nil {
+		pc.close(err)
+		if cached {
+			return nil, ErrCachedClosed
+		}
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ret, ok := <-ch:
+		if !ok {
+			pc.mu.Lock()
+			err := pc.err
+			pc.mu.Unlock()
+			if err == io.EOF && cached {
+				return nil, ErrCachedClosed
+			}
+			return nil, err
+		}
+		ret.Id = m.Id
+		if keepalive {
+			removeKeepalive(ret)
+		}
+		return ret, nil
+
+	case <-timer.C:
+		pc.mu.Lock()
+		delete(pc.pending, id)
+		pc.mu.Unlock()
+		return nil, errPipelineTimeout
+	}
+}
+
+// newID returns an ID not in flight on pc, pc.mu must be held.
+func (pc *pipelineConn) newID() uint16 {
+	for {
+		id := uint16(rand.Intn(1 << 16))
+		if _, ok := pc.pending[id]; !ok {
+			return id
+		}
+	}
+}
+
+// read hands the replies over to the waiting queries until the connection fails or times out.
+func (pc *pipelineConn) read() {
+	for {
+		ret, err := pc.c.ReadMsg()
+		if err != nil {
+			pc.close(err)
+			return
+		}
+
+		pc.mu.Lock()
+		ch, ok := pc.pending[ret.Id]
+		delete(pc.pending, ret.Id)
+		if timeout, ok := keepaliveTimeout(ret); ok {
+			if timeout == 0 {
+				pc.draining = true
+			} else {
+				pc.idle = timeout
+			}
+		}
+		done := pc.draining && len(pc.pending) == 0
+		pc.touch()
+		pc.mu.Unlock()
+
+		// a reply nobody waits for anymore is dropped.
+		if ok {
+			ch <- ret
+		}
+		if done {
+			pc.close(io.EOF)
+			return
+		}
+	}
+}
+
+// close closes the connection, the queries still waiting fail with err.
+func (pc *pipelineConn) close(err error) {
+	pc.mu.Lock()
+	if pc.err != nil {
+		pc.mu.Unlock()
+		return
+	}
+	pc.err = err
+	pending := pc.pending
+	pc.pending = nil
+	pc.mu.Unlock()
+
+	pc.c.Close()
+	for _, ch := range pending {
+		close(ch)
+	}
+}
+
+// withKeepalive returns m with an edns-tcp-keepalive option, when m has an OPT record without one. A
+// query without OPT is sent as is.
+func withKeepalive(m *dns.Msg) (*dns.Msg, bool) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return m, false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0TCPKEEPALIVE {
+			return m, false
+		}
+	}
+	m = m.Copy()
+	opt = m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	return m, true
+}
+
+// keepaliveTimeout returns the idle timeout the server sets in its edns-tcp-keepalive option, if any.
+func keepaliveTimeout(m *dns.Msg) (time.Duration, bool) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return 0, false
+	}
+	for _, o := range opt.Option {
+		if k, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+			return time.Duration(k.Timeout) * 100 * time.Millisecond, true
+		}
+	}
+	return 0, false
+}
+
+// removeKeepalive removes the edns-tcp-keepalive option from m, it only concerns this hop.
+func removeKeepalive(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0TCPKEEPALIVE {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
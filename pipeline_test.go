@@ -0,0 +1,133 @@
+package turned
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// newPipelineServer starts a TCP server answering the queries of a connection concurrently, so the replies
+// come out of order. It counts the connections, the server asks to close them when keepalive is 0.
+func newPipelineServer(t *testing.T, conns *int32, keepalive uint16) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(conns, 1)
+			go func() {
+				defer c.Close()
+				conn := &dns.Conn{Conn: c}
+				var wmu sync.Mutex
+				for {
+					m, err := conn.ReadMsg()
+					if err != nil {
+						return
+					}
+					go func() {
+						time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+						ret := new(dns.Msg)
+						ret.SetReply(m)
+						ret.Answer = append(ret.Answer, test.A(m.Question[0].Name+" 3600 IN A 192.0.2.1"))
+						if opt := m.IsEdns0(); opt != nil {
+							ret.SetEdns0(opt.UDPSize(), false)
+							for _, o := range opt.Option {
+								if o.Option() == dns.EDNS0TCPKEEPALIVE {
+									ret.IsEdns0().Option = append(ret.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: keepalive})
+								}
+							}
+						}
+						wmu.Lock()
+						conn.WriteMsg(ret)
+						wmu.Unlock()
+					}()
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestPipeline(t *testing.T) {
+	var conns int32
+	addr := newPipelineServer(t, &conns, 100)
+
+	p := NewProxy(addr, "dns")
+	p.transport.pipeline = newPipeline()
+	p.start(hcInterval)
+	defer p.stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m := new(dns.Msg)
+			m.SetQuestion("q"+strconv.Itoa(i)+".example.org.", dns.TypeA)
+			m.Id = 1 // the same ID for all the queries, they're told apart on the wire anyway.
+			if i%2 == 0 {
+				m.SetEdns0(4096, false)
+			}
+			state := request.Request{W: &test.ResponseWriter{}, Req: m}
+
+			ret, err := p.Connect(context.Background(), state, options{forceTCP: true})
+			if err != nil {
+				t.Errorf("Expected to receive reply, but didn't: %s", err)
+				return
+			}
+			if !state.Match(ret) || ret.Question[0].Name != m.Question[0].Name {
+				t.Errorf("Unexpected reply for %s: %s", m.Question[0].Name, ret)
+			}
+			if _, ok := keepaliveTimeout(ret); ok {
+				t.Errorf("Expected the keepalive option to be removed: %s", ret)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("Expected 1 connection, got %d", n)
+	}
+}
+
+func TestPipelineKeepaliveClose(t *testing.T) {
+	var conns int32
+	addr := newPipelineServer(t, &conns, 0)
+
+	p := NewProxy(addr, "dns")
+	p.transport.pipeline = newPipeline()
+	p.start(hcInterval)
+	defer p.stop()
+
+	for i := 0; i < 2; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		m.SetEdns0(4096, false)
+		state := request.Request{W: &test.ResponseWriter{}, Req: m}
+		if _, err := p.Connect(context.Background(), state, options{forceTCP: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a keepalive timeout of 0 asks to close the connection.
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Errorf("Expected 2 connections, got %d", n)
+	}
+}
@@ -1,8 +1,18 @@
 package turned
 
 import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
 	"math/rand"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
+
+	"github.com/coredns/coredns/request"
+
+	"golang.org/x/net/publicsuffix"
 )
 
 // Policy defines a policy we use for selecting upstreams.
@@ -11,6 +21,80 @@ type Policy interface {
 	String() string
 }
 
+// QueryPolicy is a Policy which orders the upstreams for each query. When the policy of a group
+// implements it, ListQuery is used instead of List.
+type QueryPolicy interface {
+	Policy
+	ListQuery(q *PolicyQuery) []*Proxy
+}
+
+// PolicyQuery is what a QueryPolicy selects the upstreams from, see Proxy.Stats for the figures of each.
+type PolicyQuery struct {
+	State    request.Request // the query
+	Group    string          // the name of the group
+	MaxFails uint32          // the max_fails of the group, an upstream is down past it, see Proxy.Down
+	Proxies  []*Proxy
+}
+
+// down reports whether p is down for the query.
+func (q *PolicyQuery) down(p *Proxy) bool { return p.Down(q.MaxFails) }
+
+// peeker is a Policy whose List advances its state, peek returns the order of the next query without
+// advancing it.
+type peeker interface {
+	peek(q *PolicyQuery) []*Proxy
+}
+
+// PolicyFactory returns a policy configured with the arguments following its name: policy NAME [ARGS...].
+type PolicyFactory func(args []string) (Policy, error)
+
+var (
+	policiesMu sync.RWMutex
+	policies   = map[string]PolicyFactory{}
+)
+
+// RegisterPolicy makes the policy name available to the policy property. It's meant to be called from the
+// init function of the package that implements it, registering a name twice panics.
+func RegisterPolicy(name string, factory PolicyFactory) {
+	policiesMu.Lock()
+	defer policiesMu.Unlock()
+	if _, ok := policies[name]; ok {
+		panic("policy named " + name + " already registered")
+	}
+	policies[name] = factory
+}
+
+// newPolicy returns the registered policy name configured with args.
+func newPolicy(name string, args []string) (Policy, error) {
+	policiesMu.RLock()
+	factory, ok := policies[name]
+	policiesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown policy '%s'", name)
+	}
+	return factory(args)
+}
+
+// noArgs returns the factory of a policy which takes no argument.
+func noArgs(policy func() Policy) PolicyFactory {
+	return func(args []string) (Policy, error) {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("unexpected arguments: %v", args)
+		}
+		return policy(), nil
+	}
+}
+
+func init() {
+	RegisterPolicy("random", noArgs(func() Policy { return &random{} }))
+	RegisterPolicy("round_robin", noArgs(func() Policy { return &roundRobin{} }))
+	RegisterPolicy("sequential", noArgs(func() Policy { return &sequential{} }))
+	RegisterPolicy("fastest", noArgs(func() Policy { return &fastest{} }))
+	RegisterPolicy("weighted", noArgs(func() Policy { return &weighted{} }))
+	RegisterPolicy("hash", newHash)
+	RegisterPolicy("race", newRace)
+}
+
 // random is a policy that implements random upstream selection.
 type random struct{}
 
@@ -46,12 +130,21 @@ func (r *roundRobin) String() string { return "round_robin" }
 func (r *roundRobin) List(p []*Proxy) []*Proxy {
 	poolLen := uint32(len(p))
 	i := atomic.AddUint32(&r.robin, 1) % poolLen
+	return first(p, int(i))
+}
 
-	robin := []*Proxy{p[i]}
-	robin = append(robin, p[:i]...)
-	robin = append(robin, p[i+1:]...)
+func (r *roundRobin) peek(q *PolicyQuery) []*Proxy {
+	poolLen := uint32(len(q.Proxies))
+	i := (atomic.LoadUint32(&r.robin) + 1) % poolLen
+	return first(q.Proxies, int(i))
+}
 
-	return robin
+// first returns p with p[i] moved first, the others follow in order.
+func first(p []*Proxy, i int) []*Proxy {
+	list := []*Proxy{p[i]}
+	list = append(list, p[:i]...)
+	list = append(list, p[i+1:]...)
+	return list
 }
 
 // sequential is a policy that selects hosts based on sequential ordering.
@@ -62,3 +155,154 @@ func (r *sequential) String() string { return "sequential" }
 func (r *sequential) List(p []*Proxy) []*Proxy {
 	return p
 }
+
+// exploreRate is the share of the queries for which policy fastest puts a random other upstream first, so
+// that the slower ones are measured again once they recover.
+const exploreRate = 0.05
+
+// fastest is a policy that orders the upstreams by the moving average of their response time, the failed
+// queries counting for a read timeout.
+type fastest struct{}
+
+func (r *fastest) String() string { return "fastest" }
+
+func (r *fastest) List(p []*Proxy) []*Proxy {
+	scores := make(map[*Proxy]float64, len(p))
+	for _, p1 := range p {
+		scores[p1] = p1.latency.score(p1.queryTimeout())
+	}
+	fast := make([]*Proxy, len(p))
+	copy(fast, p)
+	sort.SliceStable(fast, func(i, j int) bool { return scores[fast[i]] < scores[fast[j]] })
+
+	if len(fast) > 1 && rand.Float64() < exploreRate {
+		i := 1 + rand.Intn(len(fast)-1)
+		explore := fast[i]
+		copy(fast[1:i+1], fast[:i])
+		fast[0] = explore
+	}
+	return fast
+}
+
+// weighted is a policy that selects hosts in proportion to their weight, with the smooth weighted round
+// robin of nginx: the selections of a host are spread instead of following each other. The hosts that are
+// down are skipped, unless all of them are.
+type weighted struct {
+	sync.Mutex
+	current map[*Proxy]int
+}
+
+func (r *weighted) String() string { return "weighted" }
+
+// List selects among all of p, their health isn't known.
+func (r *weighted) List(p []*Proxy) []*Proxy {
+	r.Lock()
+	best, current := r.next(p, nil)
+	r.current = current
+	r.Unlock()
+	return first(p, best)
+}
+
+func (r *weighted) ListQuery(q *PolicyQuery) []*Proxy {
+	r.Lock()
+	best, current := r.next(q.Proxies, q.down)
+	r.current = current
+	r.Unlock()
+	return first(q.Proxies, best)
+}
+
+func (r *weighted) peek(q *PolicyQuery) []*Proxy {
+	r.Lock()
+	best, _ := r.next(q.Proxies, q.down)
+	r.Unlock()
+	return first(q.Proxies, best)
+}
+
+// next returns the index of the proxy of p selected next and the current weights once it's selected, r
+// must be locked. The proxies down keep their current weight, when all are down they are all taken.
+func (r *weighted) next(p []*Proxy, down func(*Proxy) bool) (int, map[*Proxy]int) {
+	// the proxies no longer listed, like the former addresses of a host upstream, are dropped.
+	current := make(map[*Proxy]int, len(p))
+	total, best := 0, -1
+	for i, p1 := range p {
+		current[p1] = r.current[p1]
+		if down != nil && down(p1) {
+			continue
+		}
+		current[p1] += p1.weight
+		total += p1.weight
+		if best < 0 || current[p1] > current[p[best]] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return r.next(p, nil)
+	}
+	current[p[best]] -= total
+	return best, current
+}
+
+// hash is a policy that orders the upstreams by rendezvous hashing of the query name, or of its registrable
+// domain, so a name is sent to the same upstream as long as it's healthy. When it goes down only its names
+// move, each to the upstream next in its order.
+type hash struct {
+	domain bool // hash the registrable domain instead of the name
+}
+
+func (r *hash) String() string { return "hash" }
+
+// newHash returns the hash policy: hash [qname|domain].
+func newHash(args []string) (Policy, error) {
+	r := &hash{}
+	switch {
+	case len(args) > 1:
+		return nil, fmt.Errorf("unexpected arguments: %v", args[1:])
+	case len(args) == 0, args[0] == "qname":
+	case args[0] == "domain":
+		r.domain = true
+	default:
+		return nil, fmt.Errorf("unknown hash key '%s', qname or domain expected", args[0])
+	}
+	return r, nil
+}
+
+// List returns p as is, the order depends on the query name.
+func (r *hash) List(p []*Proxy) []*Proxy {
+	return p
+}
+
+func (r *hash) ListQuery(q *PolicyQuery) []*Proxy {
+	return r.listName(q.State.Name(), q.Proxies)
+}
+
+// listName returns p ordered for the query name.
+func (r *hash) listName(name string, p []*Proxy) []*Proxy {
+	key := strings.ToLower(strings.TrimSuffix(name, "."))
+	if r.domain {
+		if d, err := publicsuffix.EffectiveTLDPlusOne(key); err == nil {
+			key = d
+		}
+	}
+
+	scores := make(map[*Proxy]uint64, len(p))
+	for _, p1 := range p {
+		scores[p1] = rendezvous(key, p1.addr)
+	}
+	ordered := make([]*Proxy, len(p))
+	copy(ordered, p)
+	sort.SliceStable(ordered, func(i, j int) bool { return scores[ordered[i]] > scores[ordered[j]] })
+	return ordered
+}
+
+// rendezvous returns the score of upstream addr for key.
+func rendezvous(key, addr string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(addr))
+	// FNV barely mixes the last bytes, finish with the mixer of SplitMix64.
+	x := binary.BigEndian.Uint64(h.Sum(nil))
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
@@ -0,0 +1,308 @@
+package turned
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+// newTestProxies returns plain DNS proxies to 10.0.0.1:53, 10.0.0.2:53... with the given weights.
+func newTestProxies(weights ...int) []*Proxy {
+	proxies := make([]*Proxy, len(weights))
+	for i, w := range weights {
+		proxies[i] = NewProxy("10.0.0."+strconv.Itoa(i+1)+":53", "dns")
+		proxies[i].weight = w
+	}
+	return proxies
+}
+
+func TestWeightedDistribution(t *testing.T) {
+	tests := []struct {
+		weights []int
+		n       int
+	}{
+		{[]int{4, 1}, 1000},
+		{[]int{3, 1}, 4000},
+		{[]int{1, 1, 1}, 300},
+		{[]int{5, 2, 3}, 1000},
+	}
+	for _, tc := range tests {
+		proxies := newTestProxies(tc.weights...)
+		p := &weighted{}
+		count := map[*Proxy]int{}
+		for i := 0; i < tc.n; i++ {
+			list := p.List(proxies)
+			if len(list) != len(proxies) {
+				t.Fatalf("Expected %d upstreams, got %d", len(proxies), len(list))
+			}
+			count[list[0]]++
+		}
+
+		total := 0
+		for _, w := range tc.weights {
+			total += w
+		}
+		// the count is exact once the cycles of total selections are complete.
+		for i, p1 := range proxies {
+			if want := tc.n / total * tc.weights[i]; count[p1] != want {
+				t.Errorf("Weights %v: expected upstream %d selected %d times, got %d", tc.weights, i, want, count[p1])
+			}
+		}
+	}
+}
+
+func TestWeightedSmooth(t *testing.T) {
+	proxies := newTestProxies(5, 1, 1)
+	a, b, c := proxies[0], proxies[1], proxies[2]
+	// the sequence of nginx for 5, 1 and 1.
+	want := []*Proxy{a, a, b, a, c, a, a}
+
+	p := &weighted{}
+	for cycle := 0; cycle < 3; cycle++ {
+		for i, w := range want {
+			if got := p.List(proxies)[0]; got != w {
+				t.Fatalf("Cycle %d, selection %d: expected %s, got %s", cycle, i, w.addr, got.addr)
+			}
+		}
+	}
+}
+
+func TestWeightedDown(t *testing.T) {
+	proxies := newTestProxies(4, 2, 1)
+	// the heaviest one is down.
+	proxies[0].fails = 3
+	q := &PolicyQuery{MaxFails: 2, Proxies: proxies}
+
+	p := &weighted{}
+	count := map[*Proxy]int{}
+	for i := 0; i < 300; i++ {
+		count[p.ListQuery(q)[0]]++
+	}
+	if count[proxies[0]] != 0 || count[proxies[1]] != 200 || count[proxies[2]] != 100 {
+		t.Errorf("Expected the upstreams up selected 200 and 100 times, got %d, %d and %d",
+			count[proxies[0]], count[proxies[1]], count[proxies[2]])
+	}
+
+	// all down, they are all taken.
+	proxies[1].fails, proxies[2].fails = 3, 3
+	count = map[*Proxy]int{}
+	for i := 0; i < 700; i++ {
+		count[p.ListQuery(q)[0]]++
+	}
+	if count[proxies[0]] != 400 {
+		t.Errorf("Expected the upstreams selected by weight when all are down, got %d for weight 4", count[proxies[0]])
+	}
+}
+
+func TestWeightedRemoved(t *testing.T) {
+	proxies := newTestProxies(1, 1, 1)
+	p := &weighted{}
+	p.List(proxies)
+	p.List(proxies[1:])
+	if _, ok := p.current[proxies[0]]; ok {
+		t.Error("Expected the removed upstream to be dropped")
+	}
+}
+
+func TestParseWeight(t *testing.T) {
+	c := caddy.NewTestController("dns", `turned weighted {
+		to 10.0.0.1:53^4 "tls://10.0.0.2#dns.example^2" 10.0.0.3
+		policy weighted
+	}`)
+	app, err := parseTurned(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := app.Nodes[0]
+	if f.p.String() != "weighted" {
+		t.Errorf("Expected policy weighted, got %s", f.p)
+	}
+	want := []struct {
+		addr   string
+		weight int
+	}{{"10.0.0.1:53", 4}, {"10.0.0.2:853", 2}, {"10.0.0.3:53", 1}}
+	for i, w := range want {
+		if p := f.proxies[i]; p.addr != w.addr || p.weight != w.weight {
+			t.Errorf("Expected %s^%d, got %s^%d", w.addr, w.weight, p.addr, p.weight)
+		}
+	}
+	if f.proxies[1].serverName != "dns.example" {
+		t.Errorf("Expected the server name to be kept, got %q", f.proxies[1].serverName)
+	}
+
+	for _, to := range []string{"10.0.0.1^0", "10.0.0.1^x", "10.0.0.1^"} {
+		if _, err := parseTurned(caddy.NewTestController("dns", "turned weighted {\nto "+to+"\n}")); err == nil {
+			t.Errorf("Expected an error for %q", to)
+		}
+	}
+}
+
+func TestHashConsistent(t *testing.T) {
+	proxies := newTestProxies(1, 1, 1, 1)
+	p := &hash{}
+
+	const n = 4000
+	first := map[string]*Proxy{}
+	count := map[*Proxy]int{}
+	for i := 0; i < n; i++ {
+		name := "host" + strconv.Itoa(i) + ".example.org."
+		list := p.listName(name, proxies)
+		if len(list) != len(proxies) {
+			t.Fatalf("Expected %d upstreams, got %d", len(proxies), len(list))
+		}
+		if again := p.listName(strings.ToUpper(name), proxies); again[0] != list[0] {
+			t.Fatalf("Expected %s to land on the same upstream", name)
+		}
+		first[name] = list[0]
+		count[list[0]]++
+	}
+	for _, p1 := range proxies {
+		if c := count[p1]; c < n/4*8/10 || c > n/4*12/10 {
+			t.Errorf("Expected about %d names on %s, got %d", n/4, p1.addr, c)
+		}
+	}
+
+	// without an upstream, only its names move.
+	gone := proxies[1]
+	rest := []*Proxy{proxies[0], proxies[2], proxies[3]}
+	for name, was := range first {
+		list := p.listName(name, rest)
+		if was != gone && list[0] != was {
+			t.Fatalf("Expected %s to stay on %s, got %s", name, was.addr, list[0].addr)
+		}
+		if was == gone && list[0] != p.listName(name, proxies)[1] {
+			t.Fatalf("Expected %s to move to its next upstream", name)
+		}
+	}
+}
+
+func TestHashDomain(t *testing.T) {
+	proxies := newTestProxies(1, 1, 1, 1, 1, 1, 1, 1)
+	p := &hash{domain: true}
+	want := p.listName("example.co.uk.", proxies)[0]
+	for _, name := range []string{"www.example.co.uk.", "a.b.example.co.uk.", "EXAMPLE.co.uk."} {
+		if got := p.listName(name, proxies)[0]; got != want {
+			t.Errorf("Expected %s on %s with example.co.uk, got %s", name, want.addr, got.addr)
+		}
+	}
+
+	moved := 0
+	for i := 0; i < 100; i++ {
+		if (&hash{}).listName("host"+strconv.Itoa(i)+".example.co.uk.", proxies)[0] != want {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Error("Expected the names of a domain to spread when hashing the qname")
+	}
+}
+
+func TestParseHashPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		domain bool
+		err    bool
+	}{
+		{"hash", false, false},
+		{"hash qname", false, false},
+		{"hash domain", true, false},
+		{"hash tld", false, true},
+	}
+	for _, tc := range tests {
+		app, err := parseTurned(caddy.NewTestController("dns", "turned hash {\nto 1.1.1.1 8.8.8.8\npolicy "+tc.policy+"\n}"))
+		if tc.err {
+			if err == nil {
+				t.Errorf("Expected an error for %q", tc.policy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", tc.policy, err)
+		}
+		if h, ok := app.Nodes[0].p.(*hash); !ok || h.domain != tc.domain {
+			t.Errorf("Expected hash with domain %t for %q, got %v", tc.domain, tc.policy, app.Nodes[0].p)
+		}
+	}
+}
+
+// lastPolicy puts the last upstream first, it records what it's given.
+type lastPolicy struct {
+	args []string
+	q    *PolicyQuery
+}
+
+func (r *lastPolicy) String() string { return "test_last" }
+
+func (r *lastPolicy) List(p []*Proxy) []*Proxy { return p }
+
+func (r *lastPolicy) ListQuery(q *PolicyQuery) []*Proxy {
+	r.q = q
+	list := []*Proxy{q.Proxies[len(q.Proxies)-1]}
+	return append(list, q.Proxies[:len(q.Proxies)-1]...)
+}
+
+func TestRegisterPolicy(t *testing.T) {
+	RegisterPolicy("test_last", func(args []string) (Policy, error) {
+		return &lastPolicy{args: args}, nil
+	})
+	defer func() {
+		policiesMu.Lock()
+		delete(policies, "test_last")
+		policiesMu.Unlock()
+	}()
+
+	first := newDelayedServer(t, "192.0.2.1", 0)
+	last := newDelayedServer(t, "192.0.2.2", 0)
+	app, err := parseTurned(caddy.NewTestController("dns", "turned custom {\nfrom .\nto "+first+" "+last+
+		"\nmax_fails 3\npolicy test_last a b\n}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := app.Nodes[0]
+	lp := f.p.(*lastPolicy)
+	if strings.Join(lp.args, " ") != "a b" {
+		t.Errorf("Expected the arguments a b, got %v", lp.args)
+	}
+	for _, p := range f.proxies {
+		p.start(hcInterval)
+		defer p.stop()
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeAAAA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := app.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Msg == nil || rec.Msg.Answer[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Errorf("Expected the last upstream to answer, got %v", rec.Msg)
+	}
+	if lp.q.State.QType() != dns.TypeAAAA || lp.q.Group != "custom" || lp.q.MaxFails != 3 || len(lp.q.Proxies) != 2 {
+		t.Errorf("Unexpected policy query: %+v", lp.q)
+	}
+	if s := lp.q.Proxies[1].Stats(); s.Addr != last || s.Transport != "dns" || s.Weight != 1 || s.RTT <= 0 {
+		t.Errorf("Unexpected stats of the last upstream: %+v", s)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a policy twice to panic")
+		}
+	}()
+	RegisterPolicy("test_last", noArgs(func() Policy { return &lastPolicy{} }))
+}
+
+func TestUnknownPolicy(t *testing.T) {
+	for _, policy := range []string{"nope", "random extra", "weighted 1"} {
+		if _, err := parseTurned(caddy.NewTestController("dns", "turned x {\nto 1.1.1.1\npolicy "+policy+"\n}")); err == nil {
+			t.Errorf("Expected an error for %q", policy)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package turned
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// healthProbe is the query the health checks send and what makes its reply healthy.
+type healthProbe struct {
+	name     string
+	qtype    uint16
+	rcodes   []int // the rcodes expected, any when empty
+	nonEmpty bool  // the reply must have an answer
+	tcp      bool  // send it over TCP rather than UDP, for the groups with force_tcp
+}
+
+// defaultHealthProbe asks . IN NS, any reply is healthy.
+var defaultHealthProbe = healthProbe{name: ".", qtype: dns.TypeNS}
+
+// parseHealthProbe parses health_query NAME [TYPE] [rcode RCODE...] [non_empty]. The type defaults to A, or
+// NS for the root, and the rcode to NOERROR.
+func parseHealthProbe(args []string) (healthProbe, error) {
+	if len(args) == 0 {
+		return healthProbe{}, fmt.Errorf("health_query NAME [TYPE] [rcode RCODE...] [non_empty] expected")
+	}
+	name := dns.Fqdn(args[0])
+	if _, ok := dns.IsDomainName(name); !ok {
+		return healthProbe{}, fmt.Errorf("health_query: invalid name %q", args[0])
+	}
+	hp := healthProbe{name: name, qtype: dns.TypeA}
+	if name == "." {
+		hp.qtype = dns.TypeNS
+	}
+	args = args[1:]
+	if len(args) > 0 {
+		if qtype, ok := dns.StringToType[strings.ToUpper(args[0])]; ok {
+			hp.qtype = qtype
+			args = args[1:]
+		}
+	}
+
+	inRcodes := false
+	for _, arg := range args {
+		switch {
+		case arg == "rcode":
+			inRcodes = true
+		case arg == "non_empty":
+			hp.nonEmpty, inRcodes = true, false
+		case inRcodes:
+			rcode, ok := dns.StringToRcode[strings.ToUpper(arg)]
+			if !ok {
+				return healthProbe{}, fmt.Errorf("health_query: unknown rcode %s", arg)
+			}
+			hp.rcodes = append(hp.rcodes, rcode)
+		default:
+			return healthProbe{}, fmt.Errorf("health_query: unknown option %s", arg)
+		}
+	}
+	if inRcodes && len(hp.rcodes) == 0 {
+		return healthProbe{}, fmt.Errorf("health_query: rcode needs at least one rcode")
+	}
+	if len(hp.rcodes) == 0 {
+		hp.rcodes = []int{dns.RcodeSuccess}
+	}
+	return hp, nil
+}
+
+// query returns the query of the health checks.
+func (hp healthProbe) query(recursionDesired bool) *dns.Msg {
+	ping := new(dns.Msg)
+	ping.SetQuestion(hp.name, hp.qtype)
+	ping.MsgHdr.RecursionDesired = recursionDesired
+	return ping
+}
+
+// check returns the error of a health check which got m, or err.
+func (hp healthProbe) check(m *dns.Msg, err error) error {
+	if err != nil {
+		return err
+	}
+	if len(hp.rcodes) > 0 {
+		expected := false
+		for _, rcode := range hp.rcodes {
+			expected = expected || m.Rcode == rcode
+		}
+		if !expected {
+			return fmt.Errorf("health query %s %s: unexpected rcode %s", hp.name, dns.TypeToString[hp.qtype], dns.RcodeToString[m.Rcode])
+		}
+	}
+	if hp.nonEmpty && len(m.Answer) == 0 {
+		return fmt.Errorf("health query %s %s: empty answer", hp.name, dns.TypeToString[hp.qtype])
+	}
+	return nil
+}
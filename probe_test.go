@@ -0,0 +1,123 @@
+package turned
+
+import (
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+// newProbeServer starts a DNS server refusing refused.example., with an empty answer for empty.example.
+// and an address for the other names.
+func newProbeServer(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		switch r.Question[0].Name {
+		case "refused.example.", ".":
+			ret.Rcode = dns.RcodeRefused
+		case "empty.example.":
+		default:
+			ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" 3600 IN A 192.0.2.1"))
+		}
+		w.WriteMsg(ret)
+	})}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestHealthQuery(t *testing.T) {
+	addr := newProbeServer(t)
+	tests := []struct {
+		query   string
+		healthy bool
+	}{
+		// the . IN NS of default, any reply is healthy.
+		{"", true},
+		{"health_query ok.example", true},
+		{"health_query ok.example A non_empty", true},
+		{"health_query refused.example", false},
+		{"health_query refused.example A rcode NOERROR REFUSED", true},
+		{"health_query empty.example AAAA", true},
+		{"health_query empty.example AAAA non_empty", false},
+	}
+	for _, tc := range tests {
+		app, err := parseTurned(caddy.NewTestController("dns", "turned hc {\nto "+addr+"\n"+tc.query+"\n}"))
+		if err != nil {
+			t.Fatalf("%q: %s", tc.query, err)
+		}
+		p := app.Nodes[0].proxies[0]
+		if err := p.health.Check(p); (err == nil) != tc.healthy {
+			t.Errorf("%q: expected healthy %t, got %v", tc.query, tc.healthy, err)
+		}
+	}
+}
+
+func TestHealthQueryTCP(t *testing.T) {
+	for _, forceTCP := range []bool{false, true} {
+		var udp, tcp int32
+		addr := newViaUpstream(t, &udp, &tcp)
+		input := "turned hc {\nto " + addr + "\nhealth_query example.org A non_empty\n}"
+		if forceTCP {
+			input = "turned hc {\nto " + addr + "\nhealth_query example.org A non_empty\nforce_tcp\n}"
+		}
+		app, err := parseTurned(caddy.NewTestController("dns", input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := app.Nodes[0].proxies[0]
+		if err := p.health.Check(p); err != nil {
+			t.Fatalf("Expected healthy upstream, got %s", err)
+		}
+		want := [2]int32{1, 0}
+		if forceTCP {
+			want = [2]int32{0, 1}
+		}
+		if got := [2]int32{atomic.LoadInt32(&udp), atomic.LoadInt32(&tcp)}; got != want {
+			t.Errorf("force_tcp %t: expected %v UDP and TCP probes, got %v", forceTCP, want, got)
+		}
+	}
+}
+
+func TestParseHealthProbe(t *testing.T) {
+	tests := []struct {
+		args string
+		want healthProbe
+		err  bool
+	}{
+		{"example.com", healthProbe{name: "example.com.", qtype: dns.TypeA, rcodes: []int{dns.RcodeSuccess}}, false},
+		{"example.com aaaa", healthProbe{name: "example.com.", qtype: dns.TypeAAAA, rcodes: []int{dns.RcodeSuccess}}, false},
+		{". rcode NOERROR", healthProbe{name: ".", qtype: dns.TypeNS, rcodes: []int{dns.RcodeSuccess}}, false},
+		{"example.com MX rcode noerror nxdomain non_empty", healthProbe{name: "example.com.", qtype: dns.TypeMX,
+			rcodes: []int{dns.RcodeSuccess, dns.RcodeNameError}, nonEmpty: true}, false},
+		{"", healthProbe{}, true},
+		{"example.com rcode", healthProbe{}, true},
+		{"example.com rcode BOGUS", healthProbe{}, true},
+		{"example.com A fast", healthProbe{}, true},
+	}
+	for _, tc := range tests {
+		app, err := parseTurned(caddy.NewTestController("dns", "turned hc {\nto 1.1.1.1\nhealth_query "+tc.args+"\n}"))
+		if tc.err {
+			if err == nil {
+				t.Errorf("Expected an error for %q", tc.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", tc.args, err)
+		}
+		if got := app.Nodes[0].hcProbe; !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Expected %+v for %q, got %+v", tc.want, tc.args, got)
+		}
+	}
+}
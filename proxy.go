@@ -9,39 +9,112 @@ import (
 	"github.com/coredns/coredns/plugin/pkg/up"
 )
 
-// Proxy defines an upstream host.
+// Proxy defines an upstream host as a group uses it. The groups reaching the upstream alike share its
+// *upstream, the settings of the proxy are the ones of the group.
 type Proxy struct {
+	*upstream
+
+	weight      int           // the share of the queries with policy weighted, given with ^
+	readTimeout time.Duration // 0 for the default one, tunedReadTimeout to tune it from the response times
+}
+
+// upstream is the connections and the health of an upstream host.
+type upstream struct {
 	fails uint32
 	addr  string
+	trans string
+
+	serverName string   // the TLS server name of the upstream, it takes precedence over the one of the group
+	hostName   string   // the name of a host upstream, the TLS server name when neither is given
+	pins       [][]byte // the SHA-256 of the public keys the upstream must present
 
 	transport *Transport
+	exchanger exchanger // set for upstreams not reached through transport
 
 	// health checking
 	probe  *up.Probe
 	health HealthChecker
+
+	latency latency // response time and error rate, for policy fastest
+	breaker breaker // opened by the failed queries
 }
 
 // NewProxy returns a new proxy.
 func NewProxy(addr, trans string) *Proxy {
-	p := &Proxy{
+	return newProxy(addr, trans, newExchanger(addr, trans))
+}
+
+// newProxy returns a new proxy sending its queries through ex, or through its Transport if ex is nil.
+func newProxy(addr, trans string, ex exchanger) *Proxy {
+	u := &upstream{
 		addr:      addr,
+		trans:     trans,
 		fails:     0,
 		probe:     up.New(),
 		transport: newTransport(addr),
+		exchanger: ex,
 	}
-	p.health = NewHealthChecker(trans, true)
-	runtime.SetFinalizer(p, (*Proxy).finalizer)
-	return p
+	u.transport.unix = trans == transportUnix
+	u.health = NewHealthChecker(trans, true)
+	runtime.SetFinalizer(u, (*upstream).finalizer)
+	return &Proxy{upstream: u, weight: 1}
 }
 
-// SetTLSConfig sets the TLS config in the lower p.transport and in the healthchecking client.
+// SetTLSConfig sets the TLS config in the lower p.transport and in the healthchecking client, the
+// handshakes fail when p has pins and the server presents none of them.
 func (p *Proxy) SetTLSConfig(cfg *tls.Config) {
-	p.transport.SetTLSConfig(cfg)
+	if len(p.pins) > 0 {
+		cfg = pinnedTLSConfig(cfg, p.pins)
+	}
+	if p.exchanger != nil {
+		p.exchanger.SetTLSConfig(cfg)
+	} else {
+		p.transport.SetTLSConfig(cfg)
+	}
 	p.health.SetTLSConfig(cfg)
 }
 
+// SetDialer sets the dialer in the lower p.transport and in the healthchecking client.
+func (p *Proxy) SetDialer(d dialer) {
+	p.transport.SetDialer(d)
+	if h, ok := p.health.(*dnsHc); ok {
+		h.dialer = d
+	}
+}
+
 // SetExpire sets the expire duration in the lower p.transport.
-func (p *Proxy) SetExpire(expire time.Duration) { p.transport.SetExpire(expire) }
+func (p *Proxy) SetExpire(expire time.Duration) {
+	if p.exchanger != nil {
+		p.exchanger.SetExpire(expire)
+		return
+	}
+	p.transport.SetExpire(expire)
+}
+
+// SetCircuitBreaker opens the circuit of p after threshold failed queries in a row, 0 disables it. It
+// half-opens after backoff, doubled each time it opens again up to maxBackoff.
+func (p *Proxy) SetCircuitBreaker(threshold int, backoff, maxBackoff time.Duration) {
+	p.breaker.set(p.addr, threshold, backoff, maxBackoff)
+}
+
+// SetReadTimeout sets how long a reply is waited for, 0 for the default one and tunedReadTimeout to tune it
+// from the response times of the upstream.
+func (p *Proxy) SetReadTimeout(timeout time.Duration) { p.readTimeout = timeout }
+
+// queryTimeout returns how long a reply is waited for. When tuned it's twice the average response time,
+// within minReadTimeout and readTimeout.
+func (p *Proxy) queryTimeout() time.Duration {
+	switch {
+	case p.readTimeout == tunedReadTimeout:
+		return limitTimeout(&p.transport.avgReadTime, minReadTimeout, readTimeout)
+	case p.readTimeout > 0:
+		return p.readTimeout
+	}
+	return readTimeout
+}
+
+// SetDialTimeout sets the dial timeout of the connections of p.transport, 0 tunes it from the dial times.
+func (p *Proxy) SetDialTimeout(timeout time.Duration) { p.transport.SetDialTimeout(timeout) }
 
 // Healthcheck kicks of a round of health checks for this proxy.
 func (p *Proxy) Healthcheck() {
@@ -55,8 +128,12 @@ func (p *Proxy) Healthcheck() {
 	})
 }
 
-// Down returns true if this proxy is down, i.e. has *more* fails than maxfails.
+// Down returns true if this proxy is down, i.e. has *more* fails than maxfails, or its circuit is open. It
+// doesn't change the circuit, the queries go through breaker.allow before being sent.
 func (p *Proxy) Down(maxfails uint32) bool {
+	if p.breaker.current() == breakerDown {
+		return true
+	}
 	if maxfails == 0 {
 		return false
 	}
@@ -65,13 +142,48 @@ func (p *Proxy) Down(maxfails uint32) bool {
 	return fails > maxfails
 }
 
+// ProxyStats are the figures a policy can select an upstream by.
+type ProxyStats struct {
+	Addr      string
+	Transport string
+	Weight    int           // given with ^, 1 by default
+	Fails     uint32        // the health checks failed in a row
+	RTT       time.Duration // moving average of the response time, 0 until a query succeeded
+	ErrorRate float64       // moving average of the share of the queries which failed
+	Circuit   string        // the state of the circuit breaker: up, half_open or down
+}
+
+// Stats returns the current figures of p.
+func (p *Proxy) Stats() ProxyStats {
+	rtt, errRate := p.latency.values()
+	return ProxyStats{
+		Addr:      p.addr,
+		Transport: p.trans,
+		Weight:    p.weight,
+		Fails:     atomic.LoadUint32(&p.fails),
+		RTT:       rtt,
+		ErrorRate: errRate,
+		Circuit:   p.breaker.current().String(),
+	}
+}
+
 // close stops the health checking goroutine.
-func (p *Proxy) stop()      { p.probe.Stop() }
-func (p *Proxy) finalizer() { p.transport.Stop() }
+func (p *Proxy) stop() { p.probe.Stop() }
+func (u *upstream) finalizer() {
+	if u.exchanger != nil {
+		u.exchanger.Stop()
+		return
+	}
+	u.transport.Stop()
+}
 
 // start starts the proxy's healthchecking.
 func (p *Proxy) start(duration time.Duration) {
 	p.probe.Start(duration)
+	if p.exchanger != nil {
+		p.exchanger.Start()
+		return
+	}
 	p.transport.Start()
 }
 
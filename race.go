@@ -0,0 +1,134 @@
+package turned
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// defaultRace is the number of upstreams a query is sent to with policy race when none is given.
+const defaultRace = 2
+
+// race is a policy that sends each query to the first n healthy upstreams at once, the first valid
+// reply is the answer. The upstreams are taken in the order they are configured.
+type race struct {
+	n int
+}
+
+// newRace returns the race policy: race [N].
+func newRace(args []string) (Policy, error) {
+	r := &race{n: defaultRace}
+	switch len(args) {
+	case 0:
+	case 1:
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if n < 1 {
+			return nil, fmt.Errorf("race needs at least one upstream: %d", n)
+		}
+		r.n = n
+	default:
+		return nil, fmt.Errorf("unexpected arguments: %v", args[1:])
+	}
+	return r, nil
+}
+
+func (r *race) String() string { return "race" }
+
+func (r *race) List(p []*Proxy) []*Proxy {
+	return p
+}
+
+// raceResult is the outcome of the query to one upstream.
+type raceResult struct {
+	proxy *Proxy
+	ret   *dns.Msg
+	err   error
+}
+
+// fanout sends a query to several upstreams concurrently, for race and hedge.
+type fanout struct {
+	f       *Forward
+	ctx     context.Context
+	state   request.Request
+	results chan raceResult
+	sent    int
+}
+
+// newFanout returns the fanout of the query of state to at most n upstreams, ctx cancels the queries.
+func (f *Forward) newFanout(ctx context.Context, state request.Request, n int) *fanout {
+	return &fanout{f: f, ctx: ctx, state: state, results: make(chan raceResult, n)}
+}
+
+// send sends the query to p, its result comes on o.results.
+func (o *fanout) send(p *Proxy) {
+	o.sent++
+	// every query gets its own message, the transports may change it while sending.
+	s := request.Request{W: o.state.W, Req: o.state.Req.Copy()}
+	go func() {
+		ret, err := o.f.connect(o.ctx, p, s)
+		o.results <- raceResult{proxy: p, ret: ret, err: err}
+	}()
+}
+
+// race sends the query of state to the first n healthy proxies of list concurrently and returns the first
+// reply matching it, the other queries are canceled and don't count against their upstreams. When all
+// fail it returns the last error, and a reply that didn't match if any came back.
+func (f *Forward) race(ctx context.Context, state request.Request, list []*Proxy, n int) (*dns.Msg, *Proxy, error) {
+	var racers []*Proxy
+	for _, p := range list {
+		if len(racers) == n {
+			break
+		}
+		if !p.Down(f.maxfails) && p.breaker.allow() {
+			racers = append(racers, p)
+		}
+	}
+	if len(racers) == 0 {
+		p := f.fallback(list)
+		if p == nil {
+			return nil, nil, ErrNoHealthy
+		}
+		racers = []*Proxy{p}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	out := f.newFanout(ctx, state, len(racers))
+	for _, p := range racers {
+		out.send(p)
+	}
+
+	var (
+		err   error
+		wrong *dns.Msg
+	)
+	for range racers {
+		res := <-out.results
+		if res.err != nil {
+			err = res.err
+			// Kick off health check to see if *our* upstream is broken.
+			if f.maxfails != 0 {
+				res.proxy.Healthcheck()
+			}
+			continue
+		}
+		if !state.Match(res.ret) {
+			wrong = res.ret
+			continue
+		}
+		RaceWinsCount.WithLabelValues(res.proxy.addr).Add(1)
+		return res.ret, res.proxy, nil
+	}
+	if wrong != nil {
+		return wrong, nil, nil
+	}
+	return nil, nil, err
+}
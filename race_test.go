@@ -0,0 +1,185 @@
+package turned
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newDelayedServer starts a DNS server answering ip over UDP after delay.
+func newDelayedServer(t *testing.T, ip string, delay time.Duration) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not dnstest.NewServer, its handler is shared by all the servers.
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(delay)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" 3600 IN A "+ip))
+		w.WriteMsg(ret)
+	})}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// closedAddr returns a UDP address nothing listens on.
+func closedAddr(t *testing.T) string {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := c.LocalAddr().String()
+	c.Close()
+	return addr
+}
+
+// newTestApp returns a plugin with a group forwarding . to upstreams, with the options added to the group.
+// The health checks of the upstreams run until the end of the test.
+func newTestApp(t *testing.T, options string, upstreams ...string) *Turned {
+	input := "turned test {\nfrom .\nto"
+	for _, u := range upstreams {
+		input += " " + u
+	}
+	input += "\n" + options + "\n}"
+	app, err := parseTurned(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range app.Nodes[0].proxies {
+		p.start(hcInterval)
+		t.Cleanup(p.stop)
+	}
+	return app
+}
+
+// testQuery sends a query for example.org. A through app, it returns the reply, how long it took and the
+// error of ServeDNS.
+func testQuery(app *Turned) (*dns.Msg, time.Duration, error) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	start := time.Now()
+	_, err := app.ServeDNS(context.TODO(), rec, m)
+	return rec.Msg, time.Since(start), err
+}
+
+// answerIP returns the address of the first answer of ret, "" when there's none.
+func answerIP(ret *dns.Msg) string {
+	if ret == nil || len(ret.Answer) == 0 {
+		return ""
+	}
+	return ret.Answer[0].(*dns.A).A.String()
+}
+
+func TestRace(t *testing.T) {
+	slow := newDelayedServer(t, "192.0.2.1", 500*time.Millisecond)
+	fast := newDelayedServer(t, "192.0.2.2", 0)
+
+	tests := []struct {
+		name      string
+		upstreams []string
+		winner    string
+		ip        string
+	}{
+		{"fastest answers", []string{slow, fast}, fast, "192.0.2.2"},
+		{"failure skipped", []string{closedAddr(t), fast}, fast, "192.0.2.2"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			app := newTestApp(t, "policy race 2", tc.upstreams...)
+			wins := testutil.ToFloat64(RaceWinsCount.WithLabelValues(tc.winner))
+
+			ret, d, err := testQuery(app)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d > 250*time.Millisecond {
+				t.Errorf("Expected the first reply to be returned, took %s", d)
+			}
+			if answerIP(ret) != tc.ip {
+				t.Errorf("Unexpected reply: %v", ret)
+			}
+			if n := testutil.ToFloat64(RaceWinsCount.WithLabelValues(tc.winner)); n != wins+1 {
+				t.Errorf("Expected a win recorded for %s", tc.winner)
+			}
+		})
+	}
+}
+
+func TestRaceExchanger(t *testing.T) {
+	var h2 int32
+	fast := newDelayedDoHServer(t, "192.0.2.2", 0, &h2)
+	slow := newDelayedDoHServer(t, "192.0.2.1", 100*time.Millisecond, &h2)
+	app := newTestApp(t, "policy race 2\ncircuit_breaker 1 1m\ntls "+dohCA(t, fast), fast.URL, slow.URL)
+	loser := app.Nodes[0].proxies[1]
+	before := loser.Stats()
+
+	for i := 0; i < 5; i++ {
+		if ret, _, err := testQuery(app); answerIP(ret) != "192.0.2.2" {
+			t.Fatalf("Expected the fast upstream to win, got %v %v", ret, err)
+		}
+	}
+
+	// the canceled queries of the loser say nothing about it, it keeps racing.
+	if after := loser.Stats(); after != before {
+		t.Errorf("Expected the stats of the loser unchanged, got %+v, was %+v", after, before)
+	}
+	if !loser.breaker.allow() {
+		t.Error("Expected the loser to be let through its circuit")
+	}
+}
+
+func TestRaceOnlyFirst(t *testing.T) {
+	// with race 1 the second upstream isn't asked, however faster it is.
+	slow := newDelayedServer(t, "192.0.2.1", 100*time.Millisecond)
+	fast := newDelayedServer(t, "192.0.2.2", 0)
+	app := newTestApp(t, "policy race 1", slow, fast)
+
+	ret, _, err := testQuery(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answerIP(ret) != "192.0.2.1" {
+		t.Errorf("Unexpected reply: %v", ret)
+	}
+}
+
+func TestRacePolicyParse(t *testing.T) {
+	tests := []struct {
+		policy string
+		n      int
+		err    bool
+	}{
+		{"race", defaultRace, false},
+		{"race 3", 3, false},
+		{"race 0", 0, true},
+		{"race x", 0, true},
+	}
+	for _, tc := range tests {
+		app, err := parseTurned(caddy.NewTestController("dns", "turned race {\nto 1.1.1.1 8.8.8.8\npolicy "+tc.policy+"\n}"))
+		if tc.err {
+			if err == nil {
+				t.Errorf("Expected an error for %q", tc.policy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", tc.policy, err)
+		}
+		if r, ok := app.Nodes[0].p.(*race); !ok || r.n != tc.n {
+			t.Errorf("Expected race %d for %q, got %v", tc.n, tc.policy, app.Nodes[0].p)
+		}
+	}
+}
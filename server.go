@@ -0,0 +1,54 @@
+package turned
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/reuseport"
+)
+
+// httpServer is an HTTP listener started and stopped together with the plugin.
+type httpServer struct {
+	addr string
+	mux  *http.ServeMux
+
+	ln  net.Listener
+	srv *http.Server
+}
+
+func newHTTPServer(addr string) *httpServer {
+	return &httpServer{addr: addr, mux: http.NewServeMux()}
+}
+
+func (h *httpServer) start() error {
+	ln, err := reuseport.Listen("tcp", h.addr)
+	if err != nil {
+		return err
+	}
+
+	h.ln = ln
+	h.srv = &http.Server{Handler: h.mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() { h.srv.Serve(ln) }()
+	return nil
+}
+
+func (h *httpServer) stop() error {
+	if h.srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := h.srv.Shutdown(ctx)
+	h.srv = nil
+	return err
+}
+
+// writeJSON writes v as the JSON body of a reply with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -2,6 +2,7 @@ package turned
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
@@ -13,21 +14,20 @@ func init() { plugin.Register(pluginName, setup) }
 func setup(c *caddy.Controller) error {
 	log.Infof("Initializing, %s: v%s", pluginName, pluginVer)
 
-	nodes, err := parseTurned(c)
+	app, err := parseTurned(c)
 	if err != nil {
 		return plugin.Error(pluginName, err)
 	}
 
-	for _, f := range nodes {
+	for _, f := range app.Nodes {
 		if f.Len() > max {
 			return plugin.Error(pluginName, fmt.Errorf("more than %d TOs configured: %d", max, f.Len()))
 		}
 	}
 
-	app := Turned{Nodes: nodes}
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		app.Next = next
-		return &app
+		return app
 	})
 
 	c.OnStartup(func() error {
@@ -43,20 +43,54 @@ func setup(c *caddy.Controller) error {
 
 // OnStartup starts a goroutines for all proxies.
 func (app *Turned) OnStartup() (err error) {
+	// an upstream shared by groups is started once, its health is checked at the shortest interval of them.
+	intervals := map[*upstream]time.Duration{}
+	var proxies []*Proxy
 	for _, f := range app.Nodes {
-		for _, p := range f.proxies {
-			p.start(f.hcInterval)
+		for _, p := range f.upstreams() {
+			d, ok := intervals[p.upstream]
+			if !ok {
+				proxies = append(proxies, p)
+			}
+			if !ok || f.hcInterval < d {
+				intervals[p.upstream] = f.hcInterval
+			}
 		}
 	}
+	for _, p := range proxies {
+		p.start(intervals[p.upstream])
+	}
+	for _, f := range app.Nodes {
+		f.startResolving()
+	}
+	if app.explainHTTP != nil {
+		if err := app.explainHTTP.start(); err != nil {
+			return err
+		}
+	}
+	if app.admin != nil {
+		return app.admin.start()
+	}
 	return nil
 }
 
 // OnShutdown stops all configured proxies.
 func (app *Turned) OnShutdown() error {
+	stopped := map[*upstream]bool{}
 	for _, f := range app.Nodes {
-		for _, p := range f.proxies {
-			p.stop()
+		f.stopResolving()
+		for _, p := range f.upstreams() {
+			if !stopped[p.upstream] {
+				stopped[p.upstream] = true
+				p.stop()
+			}
 		}
 	}
+	if app.explainHTTP != nil {
+		app.explainHTTP.stop()
+	}
+	if app.admin != nil {
+		return app.admin.stop()
+	}
 	return nil
 }
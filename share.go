@@ -0,0 +1,51 @@
+package turned
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// shareProxies makes the proxies of the upstreams the groups reach alike use a single *upstream, so they
+// share its connections and its health while the weight and the read timeout stay the ones of each group.
+// The upstreams given by host name are not shared, their proxies follow the resolution of the name in
+// each group.
+func (app *Turned) shareProxies() {
+	shared := map[string]*upstream{}
+	for _, f := range app.Nodes {
+		static := f.proxies
+		if len(f.hosts) > 0 {
+			static = f.static
+		}
+		for _, p := range static {
+			key := f.proxyKey(p)
+			if u, ok := shared[key]; ok {
+				p.upstream = u
+				continue
+			}
+			shared[key] = p.upstream
+		}
+	}
+}
+
+// proxyKey returns what identifies the upstream of p once set up by f: its address and transport, how it's
+// reached and the settings of the group for its connections, its health checks and its circuit breaker.
+func (f *Forward) proxyKey(p *Proxy) string {
+	pins := make([]string, len(p.pins))
+	for i, pin := range p.pins {
+		pins[i] = hex.EncodeToString(pin)
+	}
+	return strings.Join([]string{
+		p.trans,
+		p.addr,
+		p.serverName,
+		strings.Join(pins, ","),
+		fmt.Sprint(f.tlsEnabled, f.tlsArgs, f.tlsServerName),
+		f.dohMethod,
+		f.via,
+		fmt.Sprint(f.bindOptions(p.addr)),
+		fmt.Sprint(f.expire, f.dialTimeout, f.pipeline, f.minIdle),
+		fmt.Sprint(f.opts.hcRecursionDesired, f.hcProbe, f.opts.forceTCP),
+		fmt.Sprint(f.breaker),
+	}, "|")
+}
@@ -0,0 +1,68 @@
+package turned
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+func TestShareProxies(t *testing.T) {
+	c := caddy.NewTestController("dns", `
+	turned a {
+		from a.example
+		to tls://8.8.8.8 1.1.1.1
+		tls_servername dns.google
+	}
+	turned b {
+		from b.example
+		to 1.1.1.1^3 tls://8.8.8.8
+		tls_servername dns.google
+		policy sequential
+		max_fails 5
+		read_timeout 500ms
+		health_check 100ms
+	}
+	turned c {
+		from .
+		to tls://8.8.8.8 1.1.1.1
+		tls_servername other.example
+		expire 20s
+	}`)
+	app, err := parseTurned(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, cc := app.Nodes[0], app.Nodes[1], app.Nodes[2]
+
+	if a.proxies[0].upstream != b.proxies[1].upstream || a.proxies[1].upstream != b.proxies[0].upstream {
+		t.Error("Expected groups a and b to share their upstreams")
+	}
+	if a.proxies[0].upstream == cc.proxies[0].upstream {
+		t.Error("Expected a different upstream for another TLS server name")
+	}
+	// the connections of the upstream are expired alike.
+	if a.proxies[1].upstream == cc.proxies[1].upstream {
+		t.Error("Expected a different upstream for another expire")
+	}
+	// the options of the group are kept, and the settings of its proxies.
+	if b.maxfails != 5 || b.p.String() != "sequential" {
+		t.Errorf("Expected the options of group b to be kept")
+	}
+	if a.proxies[1].weight != 1 || b.proxies[0].weight != 3 {
+		t.Errorf("Expected the weights of each group, got %d and %d", a.proxies[1].weight, b.proxies[0].weight)
+	}
+	if d := a.proxies[1].queryTimeout(); d != readTimeout {
+		t.Errorf("Expected the default read timeout in group a, got %s", d)
+	}
+	if d := b.proxies[0].queryTimeout(); d != 500*time.Millisecond {
+		t.Errorf("Expected the read timeout of group b, got %s", d)
+	}
+
+	if err := app.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.OnShutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
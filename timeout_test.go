@@ -0,0 +1,140 @@
+package turned
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+func TestReadTimeout(t *testing.T) {
+	slow := newDelayedServer(t, "192.0.2.1", 500*time.Millisecond)
+	fast := newDelayedServer(t, "192.0.2.2", 0)
+	app := newTestApp(t, "policy sequential\nread_timeout 100ms", slow, fast)
+
+	ret, d, err := testQuery(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answerIP(ret) != "192.0.2.2" {
+		t.Errorf("Expected the second upstream to answer, got %v", ret)
+	}
+	if d < 100*time.Millisecond || d > 400*time.Millisecond {
+		t.Errorf("Expected the first upstream to time out after 100ms, took %s", d)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	slow := newDelayedServer(t, "192.0.2.1", 500*time.Millisecond)
+	app := newTestApp(t, "policy sequential\nread_timeout 100ms\ntimeout 250ms\nmax_fails 0", slow)
+
+	_, d, err := testQuery(app)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if d < 250*time.Millisecond || d > 450*time.Millisecond {
+		t.Errorf("Expected the query to stop after 250ms, took %s", d)
+	}
+}
+
+func TestTimeoutSingleAttempt(t *testing.T) {
+	// the timeout of the group cuts the read timeout of the only attempt short.
+	slow := newDelayedServer(t, "192.0.2.1", 500*time.Millisecond)
+	app := newTestApp(t, "policy sequential\ntimeout 200ms\nmax_fails 0", slow)
+
+	_, d, err := testQuery(app)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if d < 200*time.Millisecond || d > 400*time.Millisecond {
+		t.Errorf("Expected the query to stop after 200ms, took %s", d)
+	}
+}
+
+func TestTimeoutRace(t *testing.T) {
+	slow := newDelayedServer(t, "192.0.2.1", 500*time.Millisecond)
+	slower := newDelayedServer(t, "192.0.2.2", 600*time.Millisecond)
+	app := newTestApp(t, "policy race 2\ntimeout 200ms\nmax_fails 0", slow, slower)
+
+	_, d, err := testQuery(app)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if d < 200*time.Millisecond || d > 400*time.Millisecond {
+		t.Errorf("Expected the race to stop after 200ms, took %s", d)
+	}
+}
+
+func TestMaxAttemptsRace(t *testing.T) {
+	slow := newDelayedServer(t, "192.0.2.1", 100*time.Millisecond)
+	fast := newDelayedServer(t, "192.0.2.2", 0)
+	app := newTestApp(t, "policy race 2\nmax_attempts 1", slow, fast)
+
+	if ret, _, err := testQuery(app); answerIP(ret) != "192.0.2.1" {
+		t.Errorf("Expected only the first upstream to be queried, got %v %v", ret, err)
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	fast := newDelayedServer(t, "192.0.2.2", 0)
+
+	app := newTestApp(t, "policy sequential\nmax_attempts 1", closedAddr(t), fast)
+	if _, _, err := testQuery(app); err == nil {
+		t.Error("Expected an error after a single attempt")
+	}
+
+	app = newTestApp(t, "policy sequential\nmax_attempts 2", closedAddr(t), fast)
+	if ret, _, err := testQuery(app); err != nil || answerIP(ret) != "192.0.2.2" {
+		t.Errorf("Expected the second upstream to answer, got %v %v", ret, err)
+	}
+}
+
+func TestTunedReadTimeout(t *testing.T) {
+	p := NewProxy("127.0.0.1:53", "dns")
+	if d := p.queryTimeout(); d != readTimeout {
+		t.Errorf("Expected the default read timeout, got %s", d)
+	}
+
+	p.SetReadTimeout(tunedReadTimeout)
+	if d := p.queryTimeout(); d != readTimeout {
+		t.Errorf("Expected the tuned read timeout to start at %s, got %s", readTimeout, d)
+	}
+	for i := 0; i < 50; i++ {
+		p.transport.updateReadTimeout(10 * time.Millisecond)
+	}
+	if d := p.queryTimeout(); d != minReadTimeout {
+		t.Errorf("Expected the tuned read timeout to reach %s, got %s", minReadTimeout, d)
+	}
+	for i := 0; i < 50; i++ {
+		p.transport.updateReadTimeout(300 * time.Millisecond)
+	}
+	if d := p.queryTimeout(); d < 550*time.Millisecond || d > 650*time.Millisecond {
+		t.Errorf("Expected twice the response time, got %s", d)
+	}
+}
+
+func TestParseTimeouts(t *testing.T) {
+	app, err := parseTurned(caddy.NewTestController("dns", `turned t {
+		to 1.1.1.1
+		timeout 3s
+		read_timeout auto
+		dial_timeout 500ms
+		max_attempts 2
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := app.Nodes[0]
+	if f.timeout != 3*time.Second || f.readTimeout != tunedReadTimeout || f.dialTimeout != 500*time.Millisecond || f.maxAttempts != 2 {
+		t.Errorf("Unexpected timeouts: %s %s %s %d", f.timeout, f.readTimeout, f.dialTimeout, f.maxAttempts)
+	}
+	if d := f.proxies[0].transport.dialTimeout(); d != 500*time.Millisecond {
+		t.Errorf("Expected a dial timeout of 500ms, got %s", d)
+	}
+
+	for _, opt := range []string{"timeout 0s", "timeout", "read_timeout -1s", "read_timeout fast", "dial_timeout 0", "max_attempts 0"} {
+		if _, err := parseTurned(caddy.NewTestController("dns", "turned t {\nto 1.1.1.1\n"+opt+"\n}")); err == nil {
+			t.Errorf("Expected an error for %q", opt)
+		}
+	}
+}
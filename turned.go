@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"math/rand"
+	"net/http"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -25,8 +26,11 @@ func New() *Forward {
 		maxfails:  2,
 		tlsConfig: new(tls.Config),
 		expire:    defaultExpire, p: new(random),
+		timeout:    defaultTimeout,
 		groupName:  "final",
 		hcInterval: hcInterval,
+		hcProbe:    defaultHealthProbe,
+		dohMethod:  http.MethodPost,
 		opts:       options{forceTCP: false, preferUDP: false, hcRecursionDesired: true},
 
 		from: ".",
@@ -36,12 +40,21 @@ func New() *Forward {
 
 // SetProxy appends p to the proxy list and starts healthchecking.
 func (f *Forward) SetProxy(p *Proxy) {
+	f.mu.Lock()
 	f.proxies = append(f.proxies, p)
+	f.mu.Unlock()
 	p.start(f.hcInterval)
 }
 
 // Len returns the number of configured proxies.
-func (f *Forward) Len() int { return len(f.proxies) }
+func (f *Forward) Len() int { return len(f.upstreams()) }
+
+// upstreams returns the current proxies of f.
+func (f *Forward) upstreams() []*Proxy {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.proxies
+}
 
 // Name implements plugin.Handler.
 func (app *Turned) Name() string { return pluginName }
@@ -50,17 +63,35 @@ func (app *Turned) Name() string { return pluginName }
 func (app *Turned) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	start := time.Now()
 
-	var f *Forward
+	var (
+		f *Forward
+		m matchResult
+	)
 	question := r.Question[0]
 	qDomain := PureDomain(question.Name)
 
+	explain := app.explainDNS != nil && app.explainDNS.wants(w, question)
+	if explain {
+		qDomain = strings.TrimSuffix(qDomain, "."+explainZone)
+	}
+
 	// turned core logic
-	for _, node := range app.Nodes {
-		if node.match(qDomain) {
-			f = node
-			break
+	if app.overlay != nil {
+		f, m = app.overlay.lookup(qDomain)
+	}
+	if f == nil {
+		for _, node := range app.Nodes {
+			if m = node.lookup(qDomain); m.matched() {
+				f = node
+				break
+			}
 		}
 	}
+	matchedTime := time.Since(start)
+
+	if explain {
+		return app.explainDNS.reply(w, r, qDomain, f, m, matchedTime)
+	}
 
 	if f == nil {
 		log.Warning("next plugin \n")
@@ -92,8 +123,6 @@ func (app *Turned) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Ms
 	}
 
 	// Forward logic
-	matchedTime := time.Since(start)
-
 	state := request.Request{W: w, Req: r}
 
 	if f.maxConcurrent > 0 {
@@ -105,11 +134,46 @@ func (app *Turned) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Ms
 		}
 	}
 
+	list := f.list(state)
+	if len(list) == 0 {
+		// only host upstreams which didn't resolve yet.
+		return dns.RcodeServerFailure, ErrNoHealthy
+	}
+
+	// the attempts, and the queries of race and hedge, stop with the timeout of the group.
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	if rc, ok := f.p.(*race); ok {
+		n := rc.n
+		if f.maxAttempts > 0 && n > f.maxAttempts {
+			n = f.maxAttempts
+		}
+		ret, proxy, err := f.race(ctx, state, list, n)
+		log.Infof("%s (%s) - %s - spent: %s", f.Name(), matchedTime, qDomain, time.Since(start))
+		if err != nil {
+			return dns.RcodeServerFailure, err
+		}
+		if proxy == nil {
+			debug.Hexdumpf(ret, "Wrong reply for id: %d, %s %d", ret.Id, state.QName(), state.QType())
+
+			formerr := new(dns.Msg)
+			formerr.SetRcode(state.Req, dns.RcodeFormatError)
+			w.WriteMsg(formerr)
+			return 0, nil
+		}
+		metadata.SetValueFunc(ctx, "forward/upstream", func() string {
+			return proxy.addr
+		})
+		w.WriteMsg(ret)
+		return 0, nil
+	}
+
 	fails := 0
 	var upstreamErr error
 	i := 0
-	list := f.List()
-	deadline := time.Now().Add(defaultTimeout)
+	attempts := 0
 
 	for time.Now().Before(deadline) {
 		if i >= len(list) {
@@ -120,17 +184,14 @@ func (app *Turned) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Ms
 
 		proxy := list[i]
 		i++
-		if proxy.Down(f.maxfails) {
+		if proxy.Down(f.maxfails) || !proxy.breaker.allow() {
 			fails++
-			if fails < len(f.proxies) {
+			if fails < len(list) {
 				continue
 			}
-			// All upstream proxies are dead, assume healthcheck is completely broken and randomly
-			// select an upstream to connect to.
-			r := new(random)
-			proxy = r.List(f.proxies)[0]
-
-			HealthcheckBrokenCount.Add(1)
+			if proxy = f.fallback(list); proxy == nil {
+				break
+			}
 		}
 
 		metadata.SetValueFunc(ctx, "forward/upstream", func() string {
@@ -141,23 +202,23 @@ func (app *Turned) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Ms
 			ret *dns.Msg
 			err error
 		)
-		opts := f.opts
-		for {
-			ret, err = proxy.Connect(ctx, state, opts)
-			if err == ErrCachedClosed { // Remote side closed conn, can only happen with TCP.
-				continue
+		// a hedged query counts as two attempts, it's hedged only when both are left.
+		sent := 1
+		if next, j := f.nextUp(list, i, proxy); f.hedge != nil && next != nil && (f.maxAttempts == 0 || attempts+2 <= f.maxAttempts) {
+			ret, proxy, sent, err = f.hedged(ctx, state, proxy, next)
+			// next isn't tried again right after, the down proxies before it are skipped as usual.
+			if sent == 2 && j < len(list) {
+				fails += j - i
+				i = j + 1
 			}
-			// Retry with TCP if truncated and prefer_udp configured.
-			if ret != nil && ret.Truncated && !opts.forceTCP && opts.preferUDP {
-				opts.forceTCP = true
-				continue
-			}
-			break
+		} else {
+			ret, err = f.connect(ctx, proxy, state)
 		}
 
 		log.Infof("%s (%s) - %s - spent: %s", f.Name(), matchedTime, qDomain, time.Since(start))
 
 		upstreamErr = err
+		attempts += sent
 
 		if err != nil {
 			// Kick off health check to see if *our* upstream is broken.
@@ -165,7 +226,10 @@ func (app *Turned) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Ms
 				proxy.Healthcheck()
 			}
 
-			if fails < len(f.proxies) {
+			if f.maxAttempts > 0 && attempts >= f.maxAttempts {
+				break
+			}
+			if fails < len(list) {
 				continue
 			}
 			break
@@ -192,28 +256,73 @@ func (app *Turned) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Ms
 	return dns.RcodeServerFailure, ErrNoHealthy
 }
 
+// fallback returns a random proxy of list once all are down or held back by their circuit breaker, nil
+// when all circuits are open. A proxy down by its health checks is taken as if they were broken.
+func (f *Forward) fallback(list []*Proxy) *Proxy {
+	for _, p := range new(random).List(list) {
+		if p.breaker.current() == breakerDown {
+			continue
+		}
+		if p.Down(f.maxfails) {
+			// All upstream proxies are dead, assume healthcheck is completely broken.
+			HealthcheckBrokenCount.Add(1)
+		}
+		return p
+	}
+	return nil
+}
+
+// connect sends the query of state to proxy, again when a cached connection was closed meanwhile and
+// over TCP when the reply is truncated and prefer_udp is configured.
+func (f *Forward) connect(ctx context.Context, proxy *Proxy, state request.Request) (*dns.Msg, error) {
+	opts := f.opts
+	for {
+		ret, err := proxy.Connect(ctx, state, opts)
+		if err == ErrCachedClosed { // Remote side closed conn, can only happen with TCP.
+			continue
+		}
+		// Retry with TCP if truncated and prefer_udp configured.
+		if ret != nil && ret.Truncated && !opts.forceTCP && opts.preferUDP {
+			opts.forceTCP = true
+			continue
+		}
+		return ret, err
+	}
+}
+
 func (f *Forward) match(d string) bool {
+	return f.lookup(d).matched()
+}
+
+// lookup reports how d is matched by the rules of f.
+func (f *Forward) lookup(d string) matchResult {
 	switch true {
 	case f.from != "":
 		// log.Info("matching by from")
 
-		if !plugin.Name(f.from).Matches(d) || !f.isAllowedDomain(d) {
-			return false
+		if !plugin.Name(f.from).Matches(d) {
+			return matchResult{}
+		}
+		if ignore := f.exceptRule(d); ignore != "" {
+			return matchResult{Rule: ignore, Except: true}
 		}
-		return true
+		return matchResult{Kind: matchFrom, Rule: f.from}
 
 	case f.bottle != nil:
 		// log.Info("matching by bottle")
 
 		// hash match
 		if f.bottle.Contains(d) {
-			return true
+			return matchResult{Kind: f.bottle.kind(matchExact), Rule: d}
 		}
 		// bloom match
-		return f.useWildMode(d)
+		if wild := f.useWildMode(d); wild != "" {
+			return matchResult{Kind: f.bottle.kind(matchWildcard), Rule: wild}
+		}
+		return matchResult{}
 
 	default:
-		return false
+		return matchResult{}
 	}
 }
 
@@ -236,27 +345,31 @@ func GetWild(h string) []string {
 	return bucket
 }
 
-func (f *Forward) useWildMode(name string) bool {
+// useWildMode returns the wildcard rule matching name, or "" when there is none.
+func (f *Forward) useWildMode(name string) string {
 	dnList := GetWild(name)
 	for _, dn := range dnList {
 		if f.bottle.Contains(dn) {
-			return true
+			return dn
 		}
 	}
-	return false
+	return ""
 }
 
-func (f *Forward) isAllowedDomain(name string) bool {
+// exceptRule returns the except rule rejecting name, or "" when name is allowed.
+func (f *Forward) exceptRule(name string) string {
 	if dns.Name(name) == dns.Name(f.from) {
-		return true
+		return ""
 	}
 
+	// the rules are normalized to fully qualified names, the queried names are not.
+	name = dns.Fqdn(name)
 	for _, ignore := range f.ignored {
 		if plugin.Name(ignore).Matches(name) {
-			return false
+			return ignore
 		}
 	}
-	return true
+	return ""
 }
 
 func (f *Forward) Name() string { return f.groupName }
@@ -268,4 +381,31 @@ func (f *Forward) ForceTCP() bool { return f.opts.forceTCP }
 func (f *Forward) PreferUDP() bool { return f.opts.preferUDP }
 
 // List returns a set of proxies to be used for this client depending on the policy in f.
-func (f *Forward) List() []*Proxy { return f.p.List(f.proxies) }
+func (f *Forward) List() []*Proxy { return f.p.List(f.upstreams()) }
+
+// list returns the upstreams in the order they're tried for the query of state.
+func (f *Forward) list(state request.Request) []*Proxy {
+	if f.Len() == 0 {
+		return nil
+	}
+	if qp, ok := f.p.(QueryPolicy); ok {
+		return qp.ListQuery(&PolicyQuery{State: state, Group: f.groupName, MaxFails: f.maxfails, Proxies: f.upstreams()})
+	}
+	return f.List()
+}
+
+// peek returns the upstreams in the order the next query of state tries them, without advancing the policy.
+func (f *Forward) peek(state request.Request) []*Proxy {
+	proxies := f.upstreams()
+	if len(proxies) == 0 {
+		return nil
+	}
+	q := &PolicyQuery{State: state, Group: f.groupName, MaxFails: f.maxfails, Proxies: proxies}
+	if pk, ok := f.p.(peeker); ok {
+		return pk.peek(q)
+	}
+	if qp, ok := f.p.(QueryPolicy); ok {
+		return qp.ListQuery(q)
+	}
+	return f.p.List(proxies)
+}
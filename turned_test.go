@@ -0,0 +1,47 @@
+package turned
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestExcept(t *testing.T) {
+	inside := newDelayedServer(t, "192.0.2.1", 0)
+	finally := newDelayedServer(t, "192.0.2.2", 0)
+	input := "turned inside {\nfrom .\nto " + inside + "\nexcept b.example.com\n}\n" +
+		"turned finally {\nfrom .\nto " + finally + "\n}"
+	app, err := parseTurned(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		ip   string
+	}{
+		{"a.example.com.", "192.0.2.1"},
+		{"b.example.com.", "192.0.2.2"},
+		{"www.b.example.com.", "192.0.2.2"},
+	}
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := app.ServeDNS(ctx, rec, m)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if got := answerIP(rec.Msg); got != tc.ip {
+			t.Errorf("Expected %s to be answered with %s, got %s", tc.name, tc.ip, got)
+		}
+	}
+}
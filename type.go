@@ -2,12 +2,17 @@ package turned
 
 import "net"
 
+// transportUnix is the transport of the upstreams listening on a unix socket, unix:///run/unbound.sock.
+// The queries are framed like on TCP.
+const transportUnix = "unix"
+
 type transportType int
 
 const (
 	typeUDP transportType = iota
 	typeTCP
 	typeTLS
+	typeUnix
 	typeTotalCount // keep this last
 )
 
@@ -19,13 +24,20 @@ func stringToTransportType(s string) transportType {
 		return typeTCP
 	case "tcp-tls":
 		return typeTLS
+	case transportUnix:
+		return typeUnix
 	}
 
 	return typeUDP
 }
 
 func (t *Transport) transportTypeFromConn(pc *persistConn) transportType {
-	if _, ok := pc.c.Conn.(*net.UDPConn); ok {
+	// a *net.UnixConn is a net.PacketConn too, though a stream one.
+	if t.unix {
+		return typeUnix
+	}
+	// not only *net.UDPConn, the UDP relay of a SOCKS5 proxy is a net.PacketConn as well.
+	if _, ok := pc.c.Conn.(net.PacketConn); ok {
 		return typeUDP
 	}
 
@@ -0,0 +1,114 @@
+package turned
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return c, err
+}
+
+// newUnixServer starts a resolver stub on a unix socket in a temporary directory.
+func newUnixServer(t *testing.T) (string, *countingListener) {
+	path := filepath.Join(t.TempDir(), "dns.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &countingListener{Listener: ln}
+	s := &dns.Server{Listener: l, Net: "tcp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" 3600 IN A 192.0.2.1"))
+		w.WriteMsg(ret)
+	})}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+	return path, l
+}
+
+func TestUnixUpstream(t *testing.T) {
+	for _, pipelined := range []bool{false, true} {
+		path, l := newUnixServer(t)
+
+		c := caddy.NewTestController("dns", `turned unix {
+			from .
+			to unix://`+path+`
+		}`)
+		if pipelined {
+			c = caddy.NewTestController("dns", `turned unix {
+				from .
+				to unix://`+path+`
+				pipeline
+			}`)
+		}
+		app, err := parseTurned(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := app.Nodes[0].proxies[0]
+		if p.addr != path || p.trans != transportUnix {
+			t.Fatalf("Expected a unix proxy for %s, got %s://%s", path, p.trans, p.addr)
+		}
+		p.start(hcInterval)
+
+		for i := 0; i < 3; i++ {
+			m := new(dns.Msg)
+			m.SetQuestion("example.org.", dns.TypeA)
+			// the client asked over UDP, the socket is a stream one all the same.
+			state := request.Request{W: &test.ResponseWriter{}, Req: m}
+
+			ret, err := p.Connect(context.Background(), state, options{})
+			if err != nil {
+				t.Fatalf("Expected to receive reply, but didn't: %s", err)
+			}
+			if !state.Match(ret) || len(ret.Answer) != 1 {
+				t.Fatalf("Unexpected reply: %s", ret)
+			}
+		}
+		if n := atomic.LoadInt32(&l.accepted); n != 1 {
+			t.Errorf("Expected the connection to be reused, got %d connections (pipeline %t)", n, pipelined)
+		}
+		if err := p.health.Check(p); err != nil {
+			t.Errorf("Expected healthy upstream, got %s", err)
+		}
+		p.stop()
+	}
+}
+
+func TestUnixUpstreamParse(t *testing.T) {
+	tests := []string{
+		`turned unix {
+			to unix://run/unbound.sock
+		}`,
+		`turned unix {
+			to unix:///run/unbound.sock
+			via socks5://127.0.0.1:1080
+		}`,
+	}
+	for i, input := range tests {
+		if _, err := parseTurned(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Test %d: expected an error", i)
+		}
+	}
+}